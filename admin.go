@@ -0,0 +1,301 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"github.com/gin-gonic/gin"
+	"github.com/op/go-logging"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the key the CSRF tokens are made with, in the data directory
+const csrfKeyFile = "csrf.key"
+
+// what a browser is told when it needs to log in to the admin pages
+const adminAuthChallenge = `Basic realm="PYX metrics viewer admin", charset="UTF-8"`
+
+// where the admin session is kept in the gin context
+const adminSessionKey = "admin"
+
+// adminRoles are what admin users can be allowed to do. Moderators deal with reports, the blocklist,
+// and the card filter. Operators look after the running viewer.
+var adminRoles = []string{"moderator", "operator"}
+
+// adminPages are the pages in the admin area, and who can use them.
+var adminPages = []struct {
+	path string
+	role string
+}{
+	{"reports", "moderator"},
+	{"blocklist", "moderator"},
+	{"filter", "moderator"},
+	{"runtime", "operator"},
+}
+
+var csrfKey []byte
+
+type adminPagesHandler struct{}
+
+func init() {
+	log.Debug("Registering admin pages handler")
+	registerHandler(adminPagesHandler{})
+}
+
+func (adminPagesHandler) prepareStatements(*sql.DB) error {
+	log.Debug("Checking admin users")
+	names := map[string]bool{}
+	for _, user := range config.Admin.Users {
+		if user.Name == "" {
+			return fmt.Errorf("an admin user has no name")
+		}
+		if names[user.Name] {
+			return fmt.Errorf("there is more than one admin user named %s", user.Name)
+		}
+		names[user.Name] = true
+		for _, role := range user.Roles {
+			if !containsString(adminRoles, role) {
+				return fmt.Errorf("admin user %s has unknown role %s", user.Name, role)
+			}
+		}
+		if user.PasswordHash != "" {
+			if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+				return fmt.Errorf("admin user %s's password hash: %v", user.Name, err)
+			}
+		}
+		if user.TokenHash != "" {
+			if hash, err := hex.DecodeString(user.TokenHash); err != nil || len(hash) != sha256.Size {
+				return fmt.Errorf("admin user %s's token hash is not a hex SHA-256", user.Name)
+			}
+		}
+	}
+
+	var err error
+	csrfKey, err = loadOrCreateKey(csrfKeyFile)
+	return err
+}
+
+func (adminPagesHandler) registerEndpoints(*gin.Engine) {
+	// everything is in the admin area
+}
+
+func (adminPagesHandler) registerAdminEndpoints(r *gin.RouterGroup) {
+	log.Debug("Registering admin endpoints for admin pages handler")
+	r.GET("", getAdminHome)
+	r.GET("/runtime", requireRole("operator"), getRuntimeConfig)
+	r.POST("/runtime/loglevel", requireRole("operator"), setLogLevel)
+	r.POST("/runtime/filter", requireRole("operator"), setFilterRules)
+	r.POST("/runtime/purge", requireRole("operator"), purgeCaches)
+}
+
+// adminAuth works out who is using the admin area, and checks the CSRF token on anything that
+// changes something. Requests made with a bearer token don't need one, since browsers don't send
+// those by themselves.
+func adminAuth(c *gin.Context) {
+	user, viaToken, err := authenticateAdmin(c.Request)
+	if err != nil {
+		if kindOf(err) == errUnauthorized {
+			c.Header("WWW-Authenticate", adminAuthChallenge)
+		}
+		returnError(c, err)
+		c.Abort()
+		return
+	}
+
+	session := model.AdminSession{User: user.Name, Roles: user.Roles, CSRF: csrfToken(user.Name)}
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead && !viaToken {
+		sent := c.GetHeader("X-CSRF-Token")
+		if sent == "" {
+			sent = c.PostForm("csrf")
+		}
+		if !hmac.Equal([]byte(sent), []byte(session.CSRF)) {
+			log.Warningf("Missing or wrong CSRF token from admin user %s for %s", user.Name, c.Request.URL.Path)
+			returnError(c, newError(errForbidden, "That form is out of date. Go back, reload the page, and try again."))
+			c.Abort()
+			return
+		}
+	}
+	c.Set(adminSessionKey, session)
+	c.Next()
+}
+
+// authenticateAdmin finds the admin user a request is from, trying the reverse proxy's header, then
+// a bearer token, and then a password. It also says whether it was a bearer token.
+func authenticateAdmin(r *http.Request) (AdminUserConfig, bool, error) {
+	if header := config.Admin.ProxyHeader; header != "" {
+		if name := r.Header.Get(header); name != "" {
+			user, ok := findAdminUser(name)
+			if !ok {
+				return user, false, newError(errForbidden, "%s can't use the admin pages.", name)
+			}
+			return user, false, nil
+		}
+	}
+
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		hash := sha256.Sum256([]byte(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))))
+		sent := []byte(hex.EncodeToString(hash[:]))
+		for _, user := range config.Admin.Users {
+			if user.TokenHash != "" && subtle.ConstantTimeCompare(sent, []byte(strings.ToLower(user.TokenHash))) == 1 {
+				return user, true, nil
+			}
+		}
+		return AdminUserConfig{}, false, newError(errUnauthorized, "That token isn't valid.")
+	}
+
+	if name, password, ok := r.BasicAuth(); ok {
+		user, found := findAdminUser(name)
+		if found && user.PasswordHash != "" &&
+			bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil {
+			return user, false, nil
+		}
+		log.Warningf("Failed admin login for %s from %s", name, r.RemoteAddr)
+		return AdminUserConfig{}, false, newError(errUnauthorized, "Wrong user name or password.")
+	}
+	return AdminUserConfig{}, false, newError(errUnauthorized, "You need to log in to use the admin pages.")
+}
+
+func findAdminUser(name string) (AdminUserConfig, bool) {
+	for _, user := range config.Admin.Users {
+		if user.Name == name {
+			return user, true
+		}
+	}
+	return AdminUserConfig{}, false
+}
+
+// csrfToken is what an admin user's forms have to send back. It's the same for every page, so that
+// several can be open at once.
+func csrfToken(user string) string {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requireRole only lets admin users with the role through.
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if session := adminSession(c); !session.HasRole(role) {
+			returnError(c, newError(errForbidden, "That needs the %s role.", role))
+			c.Abort()
+		}
+	}
+}
+
+// adminSession is who is using the admin area, as worked out by adminAuth.
+func adminSession(c *gin.Context) model.AdminSession {
+	return c.MustGet(adminSessionKey).(model.AdminSession)
+}
+
+func getAdminHome(c *gin.Context) {
+	home := model.AdminHome{Admin: adminSession(c), Pages: []string{}}
+	for _, page := range adminPages {
+		if home.Admin.HasRole(page.role) {
+			home.Pages = append(home.Pages, page.path)
+		}
+	}
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(http.StatusOK, "admin", &home)
+	} else {
+		c.JSON(http.StatusOK, home)
+	}
+}
+
+func getRuntimeConfig(c *gin.Context) {
+	current := loadRuntimeConfig(c)
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(http.StatusOK, "runtime", &current)
+	} else {
+		c.JSON(http.StatusOK, current)
+	}
+}
+
+func loadRuntimeConfig(c *gin.Context) model.RuntimeConfig {
+	_, rules := currentFilter()
+	return model.RuntimeConfig{
+		Admin:              adminSession(c),
+		LogLevel:           logging.GetLevel("").String(),
+		Filter:             rules,
+		WatermarkCacheSize: watermarkCacheSize(),
+		TopCacheSize:       topCacheSize(),
+	}
+}
+
+// runtimeConfigChanged shows the settings again once they've been changed.
+func runtimeConfigChanged(c *gin.Context) {
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.Redirect(http.StatusSeeOther, "/admin/runtime")
+	} else {
+		c.JSON(http.StatusOK, loadRuntimeConfig(c))
+	}
+}
+
+func setLogLevel(c *gin.Context) {
+	level, err := logging.LogLevel(c.PostForm("level"))
+	if err != nil {
+		returnError(c, badRequestError("'%s' is not a log level.", c.PostForm("level")))
+		return
+	}
+	logging.SetLevel(level, "")
+	log.Noticef("%s set the log level to %s", adminSession(c).User, level)
+	recordAudit(adminSession(c).User, "configure", "loglevel", level.String(), "")
+	runtimeConfigChanged(c)
+}
+
+// setFilterRules starts using new card filter rules, usually ones that were just tried out on the
+// filter dashboard.
+func setFilterRules(c *gin.Context) {
+	rules := model.FilterRules{
+		Rules: formLines(c.PostForm("rules")),
+		Allow: formLines(c.PostForm("allow")),
+		Mode:  c.PostForm("mode"),
+	}
+	if err := setFilter(rules); err != nil {
+		returnError(c, badRequestError("Those rules can't be used: %v.", err))
+		return
+	}
+	log.Noticef("%s changed the card filter rules", adminSession(c).User)
+	recordAudit(adminSession(c).User, "configure", "filter", rules.Mode,
+		fmt.Sprintf("rules: %s; allow: %s", strings.Join(rules.Rules, ", "), strings.Join(rules.Allow, ", ")))
+	runtimeConfigChanged(c)
+}
+
+func purgeCaches(c *gin.Context) {
+	purged := purgeWatermarkCache()
+	lists := purgeTopCache()
+	log.Noticef("%s purged %d cached deck names and %d cached top lists", adminSession(c).User, purged, lists)
+	recordAudit(adminSession(c).User, "purge", "cache", "watermarks", "")
+	recordAudit(adminSession(c).User, "purge", "cache", "top", "")
+	runtimeConfigChanged(c)
+}
@@ -0,0 +1,146 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// adminTestRouter is the admin area with one page for each role, as the given users.
+func adminTestRouter(users []AdminUserConfig) *gin.Engine {
+	config = &Config{}
+	config.ensureDefaults()
+	config.Admin.Users = users
+	config.Admin.ProxyHeader = "X-Remote-User"
+	csrfKey = []byte("test csrf key")
+
+	r := gin.New()
+	admin := r.Group("/admin", adminAuth)
+	ok := func(c *gin.Context) { c.String(200, adminSession(c).User) }
+	admin.GET("/reports", requireRole("moderator"), ok)
+	admin.POST("/reports", requireRole("moderator"), ok)
+	admin.GET("/runtime", requireRole("operator"), ok)
+	return r
+}
+
+func TestAdminAuth(t *testing.T) {
+	password, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := sha256.Sum256([]byte("s3cret-token"))
+	r := adminTestRouter([]AdminUserConfig{
+		{Name: "mod", PasswordHash: string(password), TokenHash: hex.EncodeToString(token[:]),
+			Roles: []string{"moderator"}},
+		{Name: "op", Roles: []string{"operator"}},
+	})
+
+	basic := func(user string, password string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	header := func(name string, value string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set(name, value) }
+	}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		form   url.Values
+		auth   []func(*http.Request)
+		status int
+		user   string
+	}{
+		{"no login", "GET", "/admin/reports", nil, nil, 401, ""},
+		{"password", "GET", "/admin/reports", nil, []func(*http.Request){basic("mod", "hunter2")}, 200, "mod"},
+		{"wrong password", "GET", "/admin/reports", nil, []func(*http.Request){basic("mod", "hunter3")}, 401, ""},
+		{"unknown user", "GET", "/admin/reports", nil, []func(*http.Request){basic("nobody", "hunter2")}, 401, ""},
+		{"user without password", "GET", "/admin/runtime", nil, []func(*http.Request){basic("op", "")}, 401, ""},
+		{"token", "GET", "/admin/reports", nil,
+			[]func(*http.Request){header("Authorization", "Bearer s3cret-token")}, 200, "mod"},
+		{"wrong token", "GET", "/admin/reports", nil,
+			[]func(*http.Request){header("Authorization", "Bearer guess")}, 401, ""},
+		{"proxy", "GET", "/admin/runtime", nil, []func(*http.Request){header("X-Remote-User", "op")}, 200, "op"},
+		{"proxy unknown user", "GET", "/admin/runtime", nil,
+			[]func(*http.Request){header("X-Remote-User", "nobody")}, 403, ""},
+		{"missing role", "GET", "/admin/runtime", nil, []func(*http.Request){basic("mod", "hunter2")}, 403, ""},
+		{"missing role by proxy", "GET", "/admin/reports", nil,
+			[]func(*http.Request){header("X-Remote-User", "op")}, 403, ""},
+		{"post without csrf", "POST", "/admin/reports", nil, []func(*http.Request){basic("mod", "hunter2")}, 403, ""},
+		{"post with wrong csrf", "POST", "/admin/reports", nil,
+			[]func(*http.Request){basic("mod", "hunter2"), header("X-CSRF-Token", csrfToken("op"))}, 403, ""},
+		{"post with csrf header", "POST", "/admin/reports", nil,
+			[]func(*http.Request){basic("mod", "hunter2"), header("X-CSRF-Token", csrfToken("mod"))}, 200, "mod"},
+		{"post with csrf field", "POST", "/admin/reports", url.Values{"csrf": {csrfToken("mod")}},
+			[]func(*http.Request){basic("mod", "hunter2")}, 200, "mod"},
+		{"post by proxy without csrf", "POST", "/admin/reports", nil,
+			[]func(*http.Request){header("X-Remote-User", "mod")}, 403, ""},
+		{"post with token", "POST", "/admin/reports", nil,
+			[]func(*http.Request){header("Authorization", "Bearer s3cret-token")}, 200, "mod"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.form.Encode()))
+			if test.form != nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			for _, auth := range test.auth {
+				auth(req)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.status, w.Body.String())
+			}
+			if test.status == 401 && w.Header().Get("WWW-Authenticate") != adminAuthChallenge {
+				t.Errorf("got WWW-Authenticate %q, want %q", w.Header().Get("WWW-Authenticate"), adminAuthChallenge)
+			}
+			if test.status == 200 && w.Body.String() != test.user {
+				t.Errorf("logged in as %q, want %q", w.Body.String(), test.user)
+			}
+		})
+	}
+}
+
+func TestCsrfToken(t *testing.T) {
+	csrfKey = []byte("test csrf key")
+	if csrfToken("mod") != csrfToken("mod") {
+		t.Error("a user's CSRF token should be the same every time")
+	}
+	if csrfToken("mod") == csrfToken("op") {
+		t.Error("different users should have different CSRF tokens")
+	}
+	token := csrfToken("mod")
+	csrfKey = []byte("another key")
+	if csrfToken("mod") == token {
+		t.Error("a CSRF token should depend on the key")
+	}
+}
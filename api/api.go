@@ -0,0 +1,154 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package api defines version 1 of the viewer's JSON API, served under /api/v1.
+//
+// The types in this package are the contract. Within v1, fields will only ever be added: nothing
+// will be removed, renamed, or change type or meaning, and no route will go away. Anything that
+// can't be done that way goes into a v2 served alongside v1. The content-negotiated routes used by
+// the HTML pages (/round/:id and friends) make no such promise, and their JSON can change whenever
+// the pages need it to.
+package api
+
+import (
+	"time"
+)
+
+// Version is the path prefix for everything in this version of the API.
+const Version = "/api/v1"
+
+// Problem types used in the type member of Problem.
+const (
+	ProblemInternal     = "urn:pyx-metrics-viewer:problem:internal"
+	ProblemNotFound     = "urn:pyx-metrics-viewer:problem:not-found"
+	ProblemBadId        = "urn:pyx-metrics-viewer:problem:bad-id"
+	ProblemBadRequest   = "urn:pyx-metrics-viewer:problem:bad-request"
+	ProblemRemoved      = "urn:pyx-metrics-viewer:problem:removed"
+	ProblemUnauthorized = "urn:pyx-metrics-viewer:problem:unauthorized"
+	ProblemForbidden    = "urn:pyx-metrics-viewer:problem:forbidden"
+	ProblemRateLimited  = "urn:pyx-metrics-viewer:problem:rate-limited"
+	ProblemUnavailable  = "urn:pyx-metrics-viewer:problem:unavailable"
+	ProblemTimeout      = "urn:pyx-metrics-viewer:problem:timeout"
+)
+
+// Problem is an RFC 7807 problem details object, returned with every error response.
+type Problem struct {
+	Type     string `json:"type" doc:"URI identifying the kind of problem."`
+	Title    string `json:"title" doc:"Short summary of the kind of problem."`
+	Status   int    `json:"status" doc:"HTTP status code."`
+	Detail   string `json:"detail" doc:"Explanation of this occurrence of the problem."`
+	Instance string `json:"instance" doc:"The request URI which had the problem."`
+	Error    string `json:"error" doc:"Same as detail, for clients which predate problem details."`
+}
+
+type Card struct {
+	UID       int64  `json:"uid,omitempty" doc:"Unique ID of the card, for /card/{color}/{uid}."`
+	Text      string `json:"text" doc:"Card text. May contain a small amount of HTML markup."`
+	Watermark string `json:"watermark" doc:"Watermark printed on the card, identifying its deck."`
+	DeckId    string `json:"deckId,omitempty" doc:"Deck the watermark belongs to, for /decks/{id}, if it has a page."`
+	DeckName  string `json:"deckName,omitempty" doc:"Name of the deck the watermark belongs to."`
+	Color     string `json:"color" doc:"Either black or white."`
+	Draw      int    `json:"draw,omitempty" doc:"For black cards, how many extra cards are drawn."`
+	Pick      int    `json:"pick,omitempty" doc:"For black cards, how many white cards are played."`
+}
+
+type Play struct {
+	SessionId string `json:"sessionId" doc:"Session which made the play. Empty if it isn't shown."`
+	Player    string `json:"player" doc:"Pseudonym of the session which made the play."`
+	Winner    bool   `json:"winner" doc:"Whether this play won the round."`
+	Cards     []Card `json:"cards" doc:"White cards in the play, in the order they were played."`
+}
+
+type Round struct {
+	Id             string    `json:"id" doc:"Round ID."`
+	GameId         string    `json:"gameId" doc:"Game the round was played in."`
+	JudgeSessionId string    `json:"judgeSessionId" doc:"Session which judged the round. Empty if it isn't shown."`
+	Judge          string    `json:"judge" doc:"Pseudonym of the session which judged the round."`
+	Timestamp      time.Time `json:"timestamp" doc:"When the round was completed."`
+	BlackCard      Card      `json:"blackCard" doc:"The black card for the round."`
+	Plays          []Play    `json:"plays" doc:"Every play made in the round, including the winner."`
+}
+
+type RoundSummary struct {
+	Id        string    `json:"id" doc:"Round ID."`
+	Timestamp time.Time `json:"timestamp" doc:"When the round was completed."`
+	BlackCard Card      `json:"blackCard" doc:"The black card for the round."`
+}
+
+type Game struct {
+	Id         string         `json:"id" doc:"Game ID."`
+	Rounds     []RoundSummary `json:"rounds" doc:"Completed rounds in the game, most recent first."`
+	Scoreboard []Score        `json:"scoreboard" doc:"How each player did in the game, most wins first."`
+}
+
+type Score struct {
+	Player string `json:"player" doc:"Pseudonym of the player's session."`
+	Played int    `json:"played" doc:"Number of rounds the player played in."`
+	Won    int    `json:"won" doc:"Number of rounds the player won."`
+	Judged int    `json:"judged" doc:"Number of rounds the player judged."`
+}
+
+type GameSummary struct {
+	Id        string    `json:"id" doc:"Game ID."`
+	Timestamp time.Time `json:"timestamp" doc:"When the game was started."`
+}
+
+type Session struct {
+	Id             string         `json:"id" doc:"Session ID."`
+	PersistentId   string         `json:"persistentId" doc:"Persistent ID of the user who had the session, unless user pages need a signed link."`
+	LogInTimestamp time.Time      `json:"logInTimestamp" doc:"When the session was started."`
+	Games          []GameSummary  `json:"games" doc:"Games the session played in."`
+	PlayedRounds   []RoundSummary `json:"playedRounds" doc:"Rounds the session played in, most recent first."`
+	JudgedRounds   []RoundSummary `json:"judgedRounds" doc:"Rounds the session judged, most recent first."`
+	Hidden         bool           `json:"hidden,omitempty" doc:"The user opted out of showing their history, so there are only stats for the session."`
+}
+
+type SessionStats struct {
+	SessionId        string `json:"sessionId" doc:"Session ID."`
+	PlayedRoundCount int    `json:"playedRoundCount" doc:"Number of rounds the session played in."`
+	JudgedRoundCount int    `json:"judgedRoundCount" doc:"Number of rounds the session judged."`
+}
+
+type SessionSummary struct {
+	Id             string    `json:"id" doc:"Session ID."`
+	ServerId       string    `json:"serverId" doc:"Server the session was on."`
+	LogInTimestamp time.Time `json:"logInTimestamp" doc:"When the session was started."`
+}
+
+type User struct {
+	PersistentId     string           `json:"persistentId" doc:"Persistent ID of the user."`
+	Sessions         []SessionSummary `json:"sessions" doc:"Sessions the user has had, most recent first."`
+	Hidden           bool             `json:"hidden,omitempty" doc:"The user opted out of showing their history, so there are only counts."`
+	SessionCount     int              `json:"sessionCount,omitempty" doc:"Number of sessions the user had, if hidden."`
+	PlayedRoundCount int              `json:"playedRoundCount,omitempty" doc:"Number of rounds the user played in, if hidden."`
+	JudgedRoundCount int              `json:"judgedRoundCount,omitempty" doc:"Number of rounds the user judged, if hidden."`
+}
+
+type Deck struct {
+	Id         string `json:"id" doc:"Deck code."`
+	Name       string `json:"name" doc:"Name of the deck."`
+	WhiteCount int    `json:"whiteCount" doc:"Number of white cards the deck had."`
+	BlackCount int    `json:"blackCount" doc:"Number of black cards the deck had."`
+	WhiteCards []Card `json:"whiteCards" doc:"White cards from the deck which were dealt at least once."`
+	BlackCards []Card `json:"blackCards" doc:"Black cards from the deck which were dealt at least once."`
+}
@@ -0,0 +1,215 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// OpenAPI builds the OpenAPI 3 document for v1 from Routes and the types they return. Field
+// descriptions come from the doc tag on each field.
+func OpenAPI() map[string]interface{} {
+	g := schemaGenerator{schemas: map[string]interface{}{}}
+	paths := map[string]interface{}{}
+	for _, route := range Routes {
+		paths[Version+route.Path] = map[string]interface{}{
+			"get": g.operation(route),
+		}
+	}
+	g.schemaFor(reflect.TypeOf(Problem{}))
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "PYX Metrics Viewer API",
+			"version": "1",
+			"description": "Within v1, fields will only ever be added: nothing will be removed, renamed, " +
+				"or change type or meaning, and no route will go away. Clients must ignore fields they " +
+				"do not recognize.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+		},
+	}
+}
+
+type schemaGenerator struct {
+	schemas map[string]interface{}
+}
+
+func (g schemaGenerator) operation(route Route) map[string]interface{} {
+	params := []interface{}{}
+	for _, param := range route.Params {
+		params = append(params, map[string]interface{}{
+			"name":        param.Name,
+			"in":          "path",
+			"required":    true,
+			"description": param.Description,
+			"schema":      map[string]interface{}{"type": "string"},
+		})
+	}
+
+	if route.ContentType == "" {
+		params = append(params, map[string]interface{}{
+			"name":        "text",
+			"in":          "query",
+			"required":    false,
+			"description": "How card text is returned: as HTML with only the markup cards use, or as plain text.",
+			"schema":      map[string]interface{}{"type": "string", "enum": []string{"html", "plain"}, "default": "html"},
+		})
+	}
+
+	if route.Signed {
+		params = append(params, map[string]interface{}{
+			"name":        "sig",
+			"in":          "query",
+			"required":    false,
+			"description": "Signature from a link given out by the PYX server, if the viewer needs one.",
+			"schema":      map[string]interface{}{"type": "string"},
+		}, map[string]interface{}{
+			"name":        "expires",
+			"in":          "query",
+			"required":    false,
+			"description": "When the signed link expires, as a Unix time, if it does.",
+			"schema":      map[string]interface{}{"type": "integer"},
+		})
+	}
+
+	var content map[string]interface{}
+	if route.ContentType != "" {
+		content = map[string]interface{}{
+			route.ContentType: map[string]interface{}{
+				"schema": map[string]interface{}{"type": "string"},
+			},
+		}
+	} else {
+		content = map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": g.schemaFor(reflect.TypeOf(route.Response)),
+			},
+		}
+	}
+
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "Success.",
+			"content":     content,
+		},
+	}
+	problems := map[string]string{
+		"400": "The ID is not valid.",
+		"404": "Nothing has that ID.",
+		"410": "It has been taken down.",
+		"500": "Something unexpected went wrong.",
+		"503": "The metrics database is unavailable.",
+		"504": "The metrics database took too long to respond.",
+	}
+	if route.Signed {
+		problems["403"] = "The link isn't signed, or has expired."
+	}
+	for status, description := range problems {
+		responses[status] = map[string]interface{}{
+			"description": description,
+			"content": map[string]interface{}{
+				"application/problem+json": map[string]interface{}{
+					"schema": map[string]interface{}{"$ref": "#/components/schemas/Problem"},
+				},
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"operationId": route.OperationId,
+		"summary":     route.Summary,
+		"parameters":  params,
+		"responses":   responses,
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor returns the schema for a type, registering structs as components and referring to
+// them by name.
+func (g schemaGenerator) schemaFor(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		return g.schemaFor(t.Elem())
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": g.schemaFor(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schemaFor(t.Elem())}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case t.Kind() == reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := g.schemas[t.Name()]; ok {
+			return ref
+		}
+		// placeholder so recursive types terminate
+		g.schemas[t.Name()] = nil
+		properties := map[string]interface{}{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := strings.Split(field.Tag.Get("json"), ",")
+			if tag[0] == "-" || field.PkgPath != "" {
+				continue
+			}
+			name := tag[0]
+			if name == "" {
+				name = field.Name
+			}
+			schema := g.schemaFor(field.Type)
+			if doc := field.Tag.Get("doc"); doc != "" {
+				if _, isRef := schema["$ref"]; isRef {
+					// siblings of $ref are ignored in OpenAPI 3.0
+					schema = map[string]interface{}{"allOf": []interface{}{schema}}
+				}
+				schema["description"] = doc
+			}
+			properties[name] = schema
+			if len(tag) < 2 || tag[1] != "omitempty" {
+				required = append(required, name)
+			}
+		}
+		g.schemas[t.Name()] = map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+			"required":   required,
+		}
+		return ref
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,99 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+// Param is a path parameter of a Route.
+type Param struct {
+	Name        string
+	Description string
+}
+
+// Route describes one endpoint of the API. Path is relative to Version and uses OpenAPI's {name}
+// syntax for parameters.
+type Route struct {
+	OperationId string
+	Path        string
+	Summary     string
+	Params      []Param
+	// Response is a zero value of the type returned on success.
+	Response interface{}
+	// ContentType of a successful response. JSON if empty.
+	ContentType string
+	// Signed routes need a link signed by the PYX server, if the viewer is set up to ask for one.
+	Signed bool
+}
+
+// Routes is every GET endpoint in v1, other than the OpenAPI document itself.
+var Routes = []Route{
+	{
+		OperationId: "getRound",
+		Path:        "/rounds/{id}",
+		Summary:     "A completed round, with every play made in it.",
+		Params:      []Param{{"id", "Round ID."}},
+		Response:    Round{},
+	},
+	{
+		OperationId: "getGame",
+		Path:        "/games/{id}",
+		Summary:     "The completed rounds of a game.",
+		Params:      []Param{{"id", "Game ID."}},
+		Response:    Game{},
+	},
+	{
+		OperationId: "getSession",
+		Path:        "/sessions/{id}",
+		Summary:     "The games and rounds a session took part in.",
+		Params:      []Param{{"id", "Session ID."}},
+		Response:    Session{},
+	},
+	{
+		OperationId: "getSessionStats",
+		Path:        "/sessions/{id}/stats",
+		Summary:     "How many rounds a session played and judged.",
+		Params:      []Param{{"id", "Session ID."}},
+		Response:    SessionStats{},
+	},
+	{
+		OperationId: "getUser",
+		Path:        "/users/{id}",
+		Summary:     "The sessions a persistent ID has had.",
+		Params:      []Param{{"id", "Persistent ID."}},
+		Response:    User{},
+		Signed:      true,
+	},
+	{
+		OperationId: "getDeck",
+		Path:        "/decks/{id}",
+		Summary:     "A deck, with every card from it that was ever dealt.",
+		Params:      []Param{{"id", "Deck ID: a built-in deck's id, a Cardcast or other service's code, or ID: and any id from the deck table."}},
+		Response:    Deck{},
+	},
+	{
+		OperationId: "downloadDeck",
+		Path:        "/decks/{id}/download",
+		Summary:     "A custom deck as a CSV file.",
+		Params:      []Param{{"id", "Deck ID: a built-in deck's id, a Cardcast or other service's code, or ID: and any id from the deck table."}},
+		ContentType: "text/csv",
+	},
+}
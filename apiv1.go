@@ -0,0 +1,280 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/api"
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"github.com/gin-gonic/gin"
+)
+
+// apiV1Handler serves the versioned API. Everything here converts from our own types to the ones
+// in package api, which must only ever change in compatible ways.
+type apiV1Handler struct{}
+
+func init() {
+	log.Debug("Registering API v1 handler")
+	registerHandler(apiV1Handler{})
+}
+
+var apiV1Endpoints = map[string]gin.HandlerFunc{
+	"getRound":        apiGetRound,
+	"getGame":         apiGetGame,
+	"getSession":      apiGetSession,
+	"getSessionStats": apiGetSessionStats,
+	"getUser":         apiGetUser,
+	"getDeck":         apiGetDeck,
+	"downloadDeck":    apiDownloadDeck,
+}
+
+var openAPIParam = regexp.MustCompile(`{([^}]+)}`)
+
+func (h apiV1Handler) registerEndpoints(r *gin.Engine) {
+	log.Debug("Registering endpoints for API v1 handler")
+	spec := api.OpenAPI()
+	g := r.Group(api.Version)
+	g.GET("/openapi.json", func(c *gin.Context) {
+		c.JSON(200, spec)
+	})
+	for _, route := range api.Routes {
+		endpoint, ok := apiV1Endpoints[route.OperationId]
+		if !ok {
+			log.Fatalf("No endpoint for API operation %s", route.OperationId)
+		}
+		g.GET(openAPIParam.ReplaceAllString(route.Path, ":$1"), endpoint)
+	}
+}
+
+func (h apiV1Handler) prepareStatements(db *sql.DB) error {
+	// everything is loaded by the other handlers
+	return nil
+}
+
+func apiGetRound(c *gin.Context) {
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	round, err := loadRound(ctx, c.Param("id"))
+	if err != nil {
+		returnProblem(c, err)
+		return
+	}
+	c.JSON(200, apiRound(round))
+}
+
+func apiGetGame(c *gin.Context) {
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	game, err := loadGame(ctx, c.Param("id"))
+	if err != nil {
+		returnProblem(c, err)
+		return
+	}
+	c.JSON(200, apiGame(game))
+}
+
+func apiGetSession(c *gin.Context) {
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	session, err := loadSession(ctx, c.Param("id"))
+	if err != nil {
+		returnProblem(c, err)
+		return
+	}
+	c.JSON(200, apiSession(c.Param("id"), session))
+}
+
+func apiGetSessionStats(c *gin.Context) {
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	counts, err := loadSessionStats(ctx, c.Param("id"))
+	if err != nil {
+		returnProblem(c, err)
+		return
+	}
+	c.JSON(200, api.SessionStats{
+		SessionId:        counts.SessionId,
+		PlayedRoundCount: counts.PlayedRoundCount,
+		JudgedRoundCount: counts.JudgedRoundCount,
+	})
+}
+
+func apiGetUser(c *gin.Context) {
+	if err := checkUserLink(c, c.Param("id")); err != nil {
+		returnProblem(c, err)
+		return
+	}
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	user, err := loadUser(ctx, c.Param("id"))
+	if err != nil {
+		returnProblem(c, err)
+		return
+	}
+	c.JSON(200, apiUser(c.Param("id"), user))
+}
+
+func apiGetDeck(c *gin.Context) {
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	deck, err := loadDeck(ctx, strings.ToUpper(c.Param("id")), model.DeckFilter{})
+	if err != nil {
+		returnProblem(c, err)
+		return
+	}
+	c.JSON(200, apiDeck(deck))
+}
+
+func apiDownloadDeck(c *gin.Context) {
+	sendDeckCsv(c, returnProblem)
+}
+
+func apiTime(timestamp int64) time.Time {
+	return time.Unix(timestamp, 0).UTC()
+}
+
+func apiCard(card model.Card) api.Card {
+	deck := resolveWatermark(card.Watermark)
+	return api.Card{
+		UID:       card.UID,
+		Text:      card.Text,
+		Watermark: card.Watermark,
+		DeckId:    deck.Id,
+		DeckName:  deck.Name,
+		Color:     card.Meta.Color,
+		Draw:      int(card.Meta.Draw),
+		Pick:      int(card.Meta.Pick),
+	}
+}
+
+func apiCards(cards []model.Card) []api.Card {
+	ret := []api.Card{}
+	for _, card := range cards {
+		ret = append(ret, apiCard(card))
+	}
+	return ret
+}
+
+func apiRound(round model.Round) api.Round {
+	ret := api.Round{
+		Id:             round.RoundId,
+		GameId:         round.GameId,
+		JudgeSessionId: visibleSessionId(round.JudgeSessionId),
+		Judge:          round.Judge,
+		Timestamp:      apiTime(round.Timestamp),
+		BlackCard:      apiCard(round.BlackCard),
+		Plays:          []api.Play{},
+	}
+	for _, play := range round.Plays {
+		ret.Plays = append(ret.Plays, api.Play{
+			SessionId: visibleSessionId(play.SessionId),
+			Player:    play.Player,
+			Winner:    play.Winner,
+			Cards:     apiCards(play.Cards),
+		})
+	}
+	return ret
+}
+
+func apiRoundSummaries(rounds []model.RoundMeta) []api.RoundSummary {
+	ret := []api.RoundSummary{}
+	for _, round := range rounds {
+		ret = append(ret, api.RoundSummary{
+			Id:        round.RoundId,
+			Timestamp: apiTime(round.Timestamp),
+			BlackCard: apiCard(round.BlackCard),
+		})
+	}
+	return ret
+}
+
+func apiGame(game model.Game) api.Game {
+	ret := api.Game{
+		Id:         game.GameId,
+		Rounds:     apiRoundSummaries(game.Rounds),
+		Scoreboard: []api.Score{},
+	}
+	for _, score := range game.Scoreboard {
+		ret.Scoreboard = append(ret.Scoreboard, api.Score{
+			Player: score.Player,
+			Played: score.Played,
+			Won:    score.Won,
+			Judged: score.Judged,
+		})
+	}
+	return ret
+}
+
+func apiSession(id string, session model.SessionMeta) api.Session {
+	ret := api.Session{
+		Id:             id,
+		PersistentId:   session.PersistentId,
+		LogInTimestamp: apiTime(session.LogInTimestamp),
+		Games:          []api.GameSummary{},
+		PlayedRounds:   apiRoundSummaries(session.PlayedRounds),
+		JudgedRounds:   apiRoundSummaries(session.JudgedRounds),
+		Hidden:         session.Hidden,
+	}
+	for _, game := range session.Games {
+		ret.Games = append(ret.Games, api.GameSummary{
+			Id:        game.GameId,
+			Timestamp: apiTime(game.Timestamp),
+		})
+	}
+	return ret
+}
+
+func apiUser(id string, user model.UserMeta) api.User {
+	ret := api.User{
+		PersistentId:     id,
+		Sessions:         []api.SessionSummary{},
+		Hidden:           user.Hidden,
+		SessionCount:     user.SessionCount,
+		PlayedRoundCount: user.PlayedRoundCount,
+		JudgedRoundCount: user.JudgedRoundCount,
+	}
+	for _, session := range user.Sessions {
+		ret.Sessions = append(ret.Sessions, api.SessionSummary{
+			Id:             session.SessionId,
+			ServerId:       session.ServerId(),
+			LogInTimestamp: apiTime(session.LogInTimestamp),
+		})
+	}
+	return ret
+}
+
+func apiDeck(deck model.Deck) api.Deck {
+	return api.Deck{
+		Id:         deck.ID,
+		Name:       deck.Name,
+		WhiteCount: deck.WhiteCount,
+		BlackCount: deck.BlackCount,
+		WhiteCards: apiCards(deck.WhiteCards),
+		BlackCards: apiCards(deck.BlackCards),
+	}
+}
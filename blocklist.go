@@ -0,0 +1,321 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"github.com/gin-gonic/gin"
+)
+
+// how often to check whether the blocklist has been changed
+const blocklistReloadInterval = 10 * time.Second
+
+// what a card is replaced with when it, or the deck it's from, is blocked
+const blockedCardText = "(This card has been removed.)"
+
+// blockKinds are the kinds of thing that can be blocked.
+var blockKinds = []string{"white", "black", "round", "game", "deck"}
+
+type blocklistHandler struct{}
+
+// The blocklist is kept in a file in the data directory, so that it can be changed from the command
+// line while the viewer is running. The running viewer notices when the file changes.
+var blocklist = struct {
+	sync.RWMutex
+	modTime time.Time
+	blocks  map[string]model.Block
+}{
+	blocks: map[string]model.Block{},
+}
+
+func init() {
+	log.Debug("Registering blocklist handler")
+	registerHandler(blocklistHandler{})
+}
+
+func (blocklistHandler) prepareStatements(*sql.DB) error {
+	return reloadBlocklist()
+}
+
+func (blocklistHandler) registerEndpoints(*gin.Engine) {
+	// the blocklist is managed from the command line and the admin area
+}
+
+func (blocklistHandler) registerAdminEndpoints(r *gin.RouterGroup) {
+	log.Debug("Registering admin endpoints for blocklist handler")
+	r.GET("/blocklist", requireRole("moderator"), getBlocklistPage)
+	r.POST("/blocklist/add", requireRole("moderator"), postBlock)
+	r.POST("/blocklist/remove", requireRole("moderator"), postUnblock)
+}
+
+func (blocklistHandler) runInBackground() {
+	for {
+		time.Sleep(blocklistReloadInterval)
+		if err := reloadBlocklist(); err != nil {
+			log.Errorf("Unable to reload the blocklist, keeping the old one: %v", err)
+		}
+	}
+}
+
+// the blocklist's file in the data directory
+const blocklistFile = "blocklist.json"
+
+// blocklistEdits keeps changes made from the admin area from overwriting each other.
+var blocklistEdits sync.Mutex
+
+func blockKey(kind string, id string) string {
+	return kind + ":" + id
+}
+
+// reloadBlocklist reads the blocklist again if it has changed since it was last read.
+func reloadBlocklist() error {
+	info, err := os.Stat(dataPath(blocklistFile))
+	if os.IsNotExist(err) {
+		blocklist.Lock()
+		blocklist.modTime = time.Time{}
+		blocklist.blocks = map[string]model.Block{}
+		blocklist.Unlock()
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	blocklist.RLock()
+	unchanged := info.ModTime().Equal(blocklist.modTime)
+	blocklist.RUnlock()
+	if unchanged {
+		return nil
+	}
+	return loadBlocklist(info.ModTime())
+}
+
+// loadBlocklist reads the blocklist, which was last changed at modTime.
+func loadBlocklist(modTime time.Time) error {
+	entries, err := readBlocklist()
+	if err != nil {
+		return err
+	}
+	blocks := make(map[string]model.Block, len(entries))
+	for _, block := range entries {
+		blocks[blockKey(block.Kind, block.Id)] = block
+	}
+	blocklist.Lock()
+	blocklist.modTime = modTime
+	blocklist.blocks = blocks
+	blocklist.Unlock()
+	purgeTopCache()
+	log.Infof("Loaded the blocklist, with %d entries.", len(blocks))
+	return nil
+}
+
+// readBlocklist reads every entry in the blocklist file, oldest first.
+func readBlocklist() ([]model.Block, error) {
+	entries := []model.Block{}
+	return entries, readJSONFile(blocklistFile, &entries)
+}
+
+// writeBlocklist replaces the blocklist file, and starts using the new one straight away rather than
+// waiting to notice that it changed.
+func writeBlocklist(entries []model.Block) error {
+	if err := writeJSONFile(blocklistFile, entries); err != nil {
+		return err
+	}
+	info, err := os.Stat(dataPath(blocklistFile))
+	if err != nil {
+		return err
+	}
+	return loadBlocklist(info.ModTime())
+}
+
+// canonicalBlockId checks that id is the right sort of ID for kind, and writes it the way it's
+// written in the blocklist.
+func canonicalBlockId(kind string, id string) (string, error) {
+	switch kind {
+	case "white", "black":
+		uid, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return "", badIdError("'%s' is not a card uid.", id)
+		}
+		return strconv.FormatInt(uid, 10), nil
+	case "round", "game":
+		return id, validateId(kind, id)
+	case "deck":
+		deck, err := resolveDeckId(strings.ToUpper(id))
+		if err != nil {
+			return "", err
+		}
+		return deck.Id, nil
+	}
+	return "", badRequestError("'%s' is not something that can be blocked; use one of %s.", kind,
+		strings.Join(blockKinds, ", "))
+}
+
+// addBlock adds something to the blocklist, or updates the reason it's blocked.
+func addBlock(kind string, id string, reason string) (model.Block, error) {
+	id, err := canonicalBlockId(kind, id)
+	if err != nil {
+		return model.Block{}, err
+	}
+	blocklistEdits.Lock()
+	defer blocklistEdits.Unlock()
+	entries, err := readBlocklist()
+	if err != nil {
+		return model.Block{}, err
+	}
+	block := model.Block{Kind: kind, Id: id, Reason: reason, Added: time.Now()}
+	kept := []model.Block{}
+	for _, entry := range entries {
+		if entry.Kind != kind || entry.Id != id {
+			kept = append(kept, entry)
+		}
+	}
+	return block, writeBlocklist(append(kept, block))
+}
+
+// removeBlock takes something off the blocklist.
+func removeBlock(kind string, id string) error {
+	id, err := canonicalBlockId(kind, id)
+	if err != nil {
+		return err
+	}
+	blocklistEdits.Lock()
+	defer blocklistEdits.Unlock()
+	entries, err := readBlocklist()
+	if err != nil {
+		return err
+	}
+	kept := []model.Block{}
+	for _, entry := range entries {
+		if entry.Kind != kind || entry.Id != id {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == len(entries) {
+		return notFoundError("%s %s is not blocked.", kind, id)
+	}
+	return writeBlocklist(kept)
+}
+
+// blockedIds are the IDs of everything of a kind that's blocked, for leaving them out of queries.
+func blockedIds(kind string) []string {
+	blocklist.RLock()
+	defer blocklist.RUnlock()
+	ids := []string{}
+	for _, block := range blocklist.blocks {
+		if block.Kind == kind {
+			ids = append(ids, block.Id)
+		}
+	}
+	return ids
+}
+
+func isBlocked(kind string, id string) bool {
+	blocklist.RLock()
+	defer blocklist.RUnlock()
+	_, ok := blocklist.blocks[blockKey(kind, id)]
+	return ok
+}
+
+// checkBlocked returns an error for something that has been blocked, to be shown instead of it.
+func checkBlocked(kind string, id string) error {
+	if !isBlocked(kind, id) {
+		return nil
+	}
+	what := kind
+	if kind == "white" || kind == "black" {
+		what = kind + " card"
+	}
+	return newError(errRemoved, "This %s has been removed.", what)
+}
+
+// cardBlocked is whether a card is blocked, either by itself or because its deck is.
+func cardBlocked(card *model.Card) bool {
+	if isBlocked(card.Meta.Color, strconv.FormatInt(card.UID, 10)) {
+		return true
+	}
+	deck, ok := deckForWatermark(card.Watermark)
+	return ok && isBlocked("deck", deck.Id)
+}
+
+func getBlocklistPage(c *gin.Context) {
+	entries, err := readBlocklist()
+	if err != nil {
+		returnError(c, &viewerError{kind: errInternal, detail: "Unable to read the blocklist.", cause: err})
+		return
+	}
+	page := model.BlocklistPage{Admin: adminSession(c), Entries: entries}
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(http.StatusOK, "blocklist", &page)
+	} else {
+		c.JSON(http.StatusOK, page)
+	}
+}
+
+func postBlock(c *gin.Context) {
+	reason := strings.TrimSpace(c.PostForm("reason"))
+	if reason == "" {
+		returnError(c, badRequestError("Say why it's being blocked."))
+		return
+	}
+	block, err := addBlock(c.PostForm("kind"), strings.TrimSpace(c.PostForm("id")), reason)
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+	recordAudit(adminSession(c).User, "block", block.Kind, block.Id, block.Reason)
+	blocklistChanged(c)
+}
+
+func postUnblock(c *gin.Context) {
+	kind := c.PostForm("kind")
+	id := c.PostForm("id")
+	if err := removeBlock(kind, id); err != nil {
+		returnError(c, err)
+		return
+	}
+	recordAudit(adminSession(c).User, "unblock", kind, id, "")
+	blocklistChanged(c)
+}
+
+// blocklistChanged shows the blocklist again once it's been changed.
+func blocklistChanged(c *gin.Context) {
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.Redirect(http.StatusSeeOther, "/admin/blocklist")
+		return
+	}
+	entries, err := readBlocklist()
+	if err != nil {
+		returnError(c, &viewerError{kind: errInternal, detail: "Unable to read the blocklist.", cause: err})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,372 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// how many of the most recent rounds to show on a card's page
+const cardRecentRounds = 20
+
+// how many answers to show for a black card
+const blackCardAnswers = 50
+
+// how many example rounds to link to for each answer
+const answerExamples = 3
+
+var getWhiteCardStmt *sql.Stmt
+var getBlackCardStmt *sql.Stmt
+var getWhiteCardPickStatsStmt *sql.Stmt
+var getBlackCardRoundCountStmt *sql.Stmt
+var getWhiteCardRecentRoundsStmt *sql.Stmt
+var getBlackCardRecentRoundsStmt *sql.Stmt
+var getBlackCardAnswersStmt *sql.Stmt
+var getWhiteCardsByUidStmt *sql.Stmt
+
+type cardHandler struct{}
+
+func init() {
+	log.Debug("Registering card handler")
+	registerHandler(cardHandler{})
+}
+
+func (h cardHandler) registerEndpoints(r *gin.Engine) {
+	log.Debug("Registering endpoints for card handler")
+	r.GET("/card/white/:uid", getWhiteCard)
+	r.GET("/card/black/:uid", getBlackCard)
+	r.GET("/card/black/:uid/answers", getBlackCardAnswers)
+}
+
+func (h cardHandler) prepareStatements(db *sql.DB) error {
+	log.Debug("Preparing statements for card handler")
+	var err error
+	getWhiteCardStmt, err = db.Prepare("SELECT text, watermark FROM white_card WHERE uid = $1")
+	if err != nil {
+		return err
+	}
+	getBlackCardStmt, err = db.Prepare("SELECT text, watermark, pick, draw FROM black_card WHERE uid = $1")
+	if err != nil {
+		return err
+	}
+	getWhiteCardPickStatsStmt, err = db.Prepare("SELECT bc.pick, COUNT(*), " +
+		"  SUM(CASE WHEN jt.session_id = rc.winner_session_id THEN 1 ELSE 0 END) " +
+		"FROM round_complete__user_session__white_card jt " +
+		"JOIN round_complete rc ON rc.uid = jt.round_complete_uid " +
+		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
+		"WHERE jt.white_card_uid = $1 " +
+		"GROUP BY bc.pick " +
+		"ORDER BY bc.pick")
+	if err != nil {
+		return err
+	}
+	getBlackCardRoundCountStmt, err = db.Prepare("SELECT COUNT(*) FROM round_complete WHERE black_card_uid = $1")
+	if err != nil {
+		return err
+	}
+	// These two leave out the rounds in $2 and the games in $3, which are the blocked ones.
+	getWhiteCardRecentRoundsStmt, err = db.Prepare("SELECT rc.round_id, ((rc.meta).timestamp AT TIME ZONE 'UTC'), " +
+		"  bc.uid, bc.text, bc.watermark, bc.pick, bc.draw, (jt.session_id = rc.winner_session_id) " +
+		"FROM round_complete__user_session__white_card jt " +
+		"JOIN round_complete rc ON rc.uid = jt.round_complete_uid " +
+		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
+		"WHERE jt.white_card_uid = $1 AND NOT (rc.round_id = ANY($2)) AND NOT (rc.game_id = ANY($3)) " +
+		"ORDER BY ((rc.meta).timestamp) DESC " +
+		"LIMIT " + strconv.Itoa(cardRecentRounds))
+	if err != nil {
+		return err
+	}
+	getBlackCardRecentRoundsStmt, err = db.Prepare("SELECT rc.round_id, ((rc.meta).timestamp AT TIME ZONE 'UTC'), " +
+		"  bc.uid, bc.text, bc.watermark, bc.pick, bc.draw, false " +
+		"FROM round_complete rc " +
+		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
+		"WHERE rc.black_card_uid = $1 AND NOT (rc.round_id = ANY($2)) AND NOT (rc.game_id = ANY($3)) " +
+		"ORDER BY ((rc.meta).timestamp) DESC " +
+		"LIMIT " + strconv.Itoa(cardRecentRounds))
+	if err != nil {
+		return err
+	}
+	// Every play made with the black card, as an array of white card uids in the order they were
+	// played, grouped by that array. $2 is whether to rank by win rate instead of wins, and $3 is
+	// how many times an answer has to have been played to be ranked at all. $4 and $5 are the
+	// blocked rounds and games, which still count but aren't given as examples.
+	getBlackCardAnswersStmt, err = db.Prepare("WITH plays AS (" +
+		"  SELECT rc.round_id, (jt.session_id = rc.winner_session_id) won, " +
+		"    (rc.round_id = ANY($4) OR rc.game_id = ANY($5)) blocked, " +
+		"    array_agg(jt.white_card_uid ORDER BY jt.white_card_index) cards " +
+		"  FROM round_complete rc " +
+		"  JOIN round_complete__user_session__white_card jt ON jt.round_complete_uid = rc.uid " +
+		"  WHERE rc.black_card_uid = $1 " +
+		"  GROUP BY rc.uid, rc.round_id, rc.game_id, rc.winner_session_id, jt.session_id" +
+		") " +
+		"SELECT cards, COUNT(*) played, SUM(CASE WHEN won THEN 1 ELSE 0 END) wins, " +
+		"  (array_remove(array_agg(CASE WHEN won AND NOT blocked THEN round_id END), NULL))[1:" + strconv.Itoa(answerExamples) + "] " +
+		"FROM plays " +
+		"GROUP BY cards " +
+		"HAVING SUM(CASE WHEN won THEN 1 ELSE 0 END) > 0 AND COUNT(*) >= $3 " +
+		"ORDER BY CASE WHEN $2 THEN SUM(CASE WHEN won THEN 1 ELSE 0 END)::float / COUNT(*) END DESC, " +
+		"  wins DESC, played ASC " +
+		"LIMIT " + strconv.Itoa(blackCardAnswers))
+	if err != nil {
+		return err
+	}
+	getWhiteCardsByUidStmt, err = db.Prepare("SELECT uid, text, watermark FROM white_card WHERE uid = ANY($1)")
+	return err
+}
+
+func getWhiteCard(c *gin.Context) {
+	getCard(c, "white")
+}
+
+func getBlackCard(c *gin.Context) {
+	getCard(c, "black")
+}
+
+func getCard(c *gin.Context, color string) {
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	stats, err := loadCardStats(ctx, color, c.Param("uid"))
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(200, "card", &stats)
+	} else {
+		c.JSON(200, stats)
+	}
+}
+
+func parseCardUid(strUid string) (int64, error) {
+	uid, err := strconv.ParseInt(strUid, 10, 64)
+	if err != nil || uid <= 0 {
+		return 0, badIdError("'%s' is not a valid card ID.", strUid)
+	}
+	return uid, nil
+}
+
+func loadCardStats(ctx context.Context, color string, strUid string) (model.CardStats, error) {
+	uid, err := parseCardUid(strUid)
+	if err != nil {
+		return model.CardStats{}, err
+	}
+
+	stats := model.CardStats{
+		Card: model.Card{
+			UID:  uid,
+			Meta: model.CardMeta{Color: color},
+		},
+	}
+	card := &stats.Card
+	if color == "white" {
+		err = getWhiteCardStmt.QueryRowContext(ctx, uid).Scan(&card.Text, &card.Watermark)
+	} else {
+		err = getBlackCardStmt.QueryRowContext(ctx, uid).Scan(&card.Text, &card.Watermark, &card.Meta.Pick,
+			&card.Meta.Draw)
+	}
+	if err == sql.ErrNoRows {
+		return model.CardStats{}, notFoundError("That %s card cannot be found.", color)
+	} else if err != nil {
+		return model.CardStats{}, dbError(err, "Unable to query for %s card %d.", color, uid)
+	}
+	filterCard(ctx, card)
+
+	if color == "white" {
+		q, err := getWhiteCardPickStatsStmt.QueryContext(ctx, uid)
+		if err != nil {
+			return model.CardStats{}, dbError(err, "Unable to query stats for white card %d.", uid)
+		}
+		defer q.Close()
+		for q.Next() {
+			var pick model.PickStats
+			err = q.Scan(&pick.Pick, &pick.Rounds, &pick.Wins)
+			if err != nil {
+				return model.CardStats{}, dbError(err, "Unable to read stats for white card %d.", uid)
+			}
+			stats.ByPick = append(stats.ByPick, pick)
+			stats.Rounds += pick.Rounds
+			stats.Wins += pick.Wins
+		}
+		if q.Err() != nil {
+			return model.CardStats{}, dbError(q.Err(), "Unable to read stats for white card %d.", uid)
+		}
+	} else {
+		err = getBlackCardRoundCountStmt.QueryRowContext(ctx, uid).Scan(&stats.Rounds)
+		if err != nil {
+			return model.CardStats{}, dbError(err, "Unable to query stats for black card %d.", uid)
+		}
+	}
+
+	recent := getWhiteCardRecentRoundsStmt
+	if color == "black" {
+		recent = getBlackCardRecentRoundsStmt
+	}
+	q, err := recent.QueryContext(ctx, uid, pq.Array(blockedIds("round")), pq.Array(blockedIds("game")))
+	if err != nil {
+		return model.CardStats{}, dbError(err, "Unable to query rounds for %s card %d.", color, uid)
+	}
+	defer q.Close()
+	for q.Next() {
+		round := model.CardRound{BlackCard: model.Card{Meta: model.CardMeta{Color: "black"}}}
+		var timestamp time.Time
+		err = q.Scan(&round.RoundId, &timestamp, &round.BlackCard.UID, &round.BlackCard.Text,
+			&round.BlackCard.Watermark, &round.BlackCard.Meta.Pick, &round.BlackCard.Meta.Draw, &round.Won)
+		if err != nil {
+			return model.CardStats{}, dbError(err, "Unable to read rounds for %s card %d.", color, uid)
+		}
+		filterCard(ctx, &round.BlackCard)
+		round.Timestamp = timestamp.Unix()
+		stats.RecentRounds = append(stats.RecentRounds, round)
+	}
+	if q.Err() != nil {
+		return model.CardStats{}, dbError(q.Err(), "Unable to read rounds for %s card %d.", color, uid)
+	}
+	return stats, nil
+}
+
+func getBlackCardAnswers(c *gin.Context) {
+	sortBy := c.DefaultQuery("sort", "wins")
+	if sortBy != "wins" && sortBy != "rate" {
+		sortBy = "wins"
+	}
+	minPlays, err := strconv.Atoi(c.DefaultQuery("min", "1"))
+	if err != nil || minPlays < 1 {
+		minPlays = 1
+	}
+
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	answers, err := loadBlackCardAnswers(ctx, c.Param("uid"), sortBy, minPlays)
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(200, "answers", &answers)
+	} else {
+		c.JSON(200, answers)
+	}
+}
+
+func loadBlackCardAnswers(ctx context.Context, strUid string, sortBy string, minPlays int) (model.BlackCardAnswers, error) {
+	uid, err := parseCardUid(strUid)
+	if err != nil {
+		return model.BlackCardAnswers{}, err
+	}
+
+	answers := model.BlackCardAnswers{
+		BlackCard: model.Card{
+			UID:  uid,
+			Meta: model.CardMeta{Color: "black"},
+		},
+		SortedBy: sortBy,
+		MinPlays: minPlays,
+		Answers:  []model.Answer{},
+	}
+	card := &answers.BlackCard
+	err = getBlackCardStmt.QueryRowContext(ctx, uid).Scan(&card.Text, &card.Watermark, &card.Meta.Pick,
+		&card.Meta.Draw)
+	if err == sql.ErrNoRows {
+		return model.BlackCardAnswers{}, notFoundError("That black card cannot be found.")
+	} else if err != nil {
+		return model.BlackCardAnswers{}, dbError(err, "Unable to query for black card %d.", uid)
+	}
+	filterCard(ctx, card)
+
+	q, err := getBlackCardAnswersStmt.QueryContext(ctx, uid, sortBy == "rate", minPlays,
+		pq.Array(blockedIds("round")), pq.Array(blockedIds("game")))
+	if err != nil {
+		return model.BlackCardAnswers{}, dbError(err, "Unable to query answers for black card %d.", uid)
+	}
+	defer q.Close()
+	answerUids := [][]int64{}
+	allUids := []int64{}
+	for q.Next() {
+		var uids []int64
+		var examples []string
+		answer := model.Answer{}
+		err = q.Scan(pq.Array(&uids), &answer.Plays, &answer.Wins, pq.Array(&examples))
+		if err != nil {
+			return model.BlackCardAnswers{}, dbError(err, "Unable to read answers for black card %d.", uid)
+		}
+		answer.ExampleRoundIds = examples
+		if answer.ExampleRoundIds == nil {
+			answer.ExampleRoundIds = []string{}
+		}
+		answers.Answers = append(answers.Answers, answer)
+		answerUids = append(answerUids, uids)
+		allUids = append(allUids, uids...)
+	}
+	if q.Err() != nil {
+		return model.BlackCardAnswers{}, dbError(q.Err(), "Unable to read answers for black card %d.", uid)
+	}
+	q.Close()
+
+	whiteCards, err := loadWhiteCardsByUid(ctx, allUids)
+	if err != nil {
+		return model.BlackCardAnswers{}, err
+	}
+	for i, uids := range answerUids {
+		for _, whiteUid := range uids {
+			answers.Answers[i].Cards = append(answers.Answers[i].Cards, whiteCards[whiteUid])
+		}
+	}
+	return answers, nil
+}
+
+// loadWhiteCardsByUid loads white cards, filtered, all at once.
+func loadWhiteCardsByUid(ctx context.Context, uids []int64) (map[int64]model.Card, error) {
+	cards := map[int64]model.Card{}
+	if len(uids) == 0 {
+		return cards, nil
+	}
+	q, err := getWhiteCardsByUidStmt.QueryContext(ctx, pq.Array(uids))
+	if err != nil {
+		return nil, dbError(err, "Unable to query for white cards.")
+	}
+	defer q.Close()
+	for q.Next() {
+		card := model.Card{Meta: model.CardMeta{Color: "white"}}
+		err = q.Scan(&card.UID, &card.Text, &card.Watermark)
+		if err != nil {
+			return nil, dbError(err, "Unable to read white cards.")
+		}
+		filterCard(ctx, &card)
+		cards[card.UID] = card
+	}
+	if q.Err() != nil {
+		return nil, dbError(q.Err(), "Unable to read white cards.")
+	}
+	return cards, nil
+}
@@ -0,0 +1,438 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A command looks something up the same way the web pages do, and prints it to out in the given
+// format.
+type command struct {
+	arg     string
+	summary string
+	formats []string
+	run     func(ctx context.Context, id string, format string, out io.Writer) error
+}
+
+var commands = map[string]command{
+	"round": {
+		arg:     "round-id",
+		summary: "Show every play in a round.",
+		formats: []string{"json", "table", "csv"},
+		run:     printRound,
+	},
+	"game": {
+		arg:     "game-id",
+		summary: "List the rounds in a game.",
+		formats: []string{"json", "table", "csv"},
+		run:     printGame,
+	},
+	"session": {
+		arg:     "session-id",
+		summary: "List the games and rounds a session took part in.",
+		formats: []string{"json", "table", "csv"},
+		run:     printSession,
+	},
+	"user": {
+		arg:     "persistent-id",
+		summary: "List the sessions a persistent ID has had.",
+		formats: []string{"json", "table", "csv"},
+		run:     printUser,
+	},
+	"deck": {
+		arg:     "code",
+		summary: "Show the cards in a custom deck.",
+		formats: []string{"json", "table", "csv"},
+		run:     printDeck,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [--config file] [serve] [server flags...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [--config file] <command> <id> [--format format] [--plain]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [--config file] blocklist [list | add <kind> <id> <reason> | remove <kind> <id>]\n",
+		os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s hash-password | new-token\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [--config file] sign-user-link <persistent id> [--expires duration]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(os.Stderr, "  %s <%s> [--format %s] [--plain]\n      %s\n", name, cmd.arg,
+			strings.Join(cmd.formats, "|"), cmd.summary)
+	}
+}
+
+// runCommand runs the command named by args[0], returning the exit status.
+func runCommand(configPath string, args []string) int {
+	switch args[0] {
+	case "blocklist":
+		return runBlocklistCommand(configPath, args[1:])
+	case "hash-password":
+		return runHashPasswordCommand()
+	case "new-token":
+		return runNewTokenCommand()
+	case "sign-user-link":
+		return runSignUserLinkCommand(configPath, args[1:])
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		if args[0] != "help" {
+			fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", args[0])
+		}
+		usage()
+		return 2
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	format := flags.String("format", cmd.formats[0], "Output format: "+strings.Join(cmd.formats, ", "))
+	plain := flags.Bool("plain", false, "Show card text without any markup")
+	// allow the flags to come before or after the ID
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s <%s> [--format %s] [--plain]\n", os.Args[0], args[0], cmd.arg,
+			strings.Join(cmd.formats, "|"))
+		return 2
+	}
+	id := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		return 2
+	}
+	if !containsString(cmd.formats, *format) {
+		fmt.Fprintf(os.Stderr, "Unknown format %s, must be one of %s\n", *format, strings.Join(cmd.formats, ", "))
+		return 2
+	}
+
+	config = loadConfig(configPath, []string{})
+	db, err := setUp()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if *plain {
+		ctx = withPlainText(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout())
+	defer cancel()
+	err = cmd.run(ctx, id, *format, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, publicDetail(err))
+		log.Debugf("%s %s failed: %v", args[0], id, err)
+		if kind := kindOf(err); kind == errNotFound || kind == errRemoved {
+			return 3
+		}
+		return 1
+	}
+	return 0
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// JSON output uses the same types as /api/v1, as it's much more likely to be fed to other tools than
+// read.
+func printJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printTable(out io.Writer, header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func printCSV(out io.Writer, header []string, rows [][]string) error {
+	w := csv.NewWriter(out)
+	w.Write(header)
+	w.WriteAll(rows)
+	return w.Error()
+}
+
+// who the audit log says made changes from the command line
+const cliAdmin = "command line"
+
+// runBlocklistCommand lists, adds to, or removes from the blocklist. It doesn't need the database,
+// and a running viewer picks up the changes by itself.
+func runBlocklistCommand(configPath string, args []string) int {
+	config = loadConfig(configPath, []string{})
+	var err error
+	// deck IDs are written the same way everywhere, whichever way they were given
+	deckIdResolvers, err = newDeckIdResolvers(config.Decks)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch {
+	case len(args) == 0 || (args[0] == "list" && len(args) == 1):
+		var entries []model.Block
+		entries, err = readBlocklist()
+		if err == nil {
+			rows := [][]string{}
+			for _, entry := range entries {
+				rows = append(rows, []string{entry.Kind, entry.Id, entry.FormattedAdded(), entry.Reason})
+			}
+			err = printTable(os.Stdout, []string{"kind", "id", "added", "reason"}, rows)
+		}
+	case args[0] == "add" && len(args) >= 4:
+		var block model.Block
+		block, err = addBlock(args[1], args[2], strings.Join(args[3:], " "))
+		if err == nil {
+			recordAudit(cliAdmin, "block", block.Kind, block.Id, block.Reason)
+			fmt.Printf("Blocked %s %s.\n", block.Kind, block.Id)
+		}
+	case args[0] == "remove" && len(args) == 3:
+		err = removeBlock(args[1], args[2])
+		if err == nil {
+			recordAudit(cliAdmin, "unblock", args[1], args[2], "")
+			fmt.Printf("Unblocked %s %s.\n", args[1], args[2])
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: %s blocklist [list | add <kind> <id> <reason> | remove <kind> <id>]\n",
+			os.Args[0])
+		fmt.Fprintf(os.Stderr, "       kind is one of %s\n", strings.Join(blockKinds, ", "))
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func printRows(format string, out io.Writer, header []string, rows [][]string) error {
+	if format == "csv" {
+		return printCSV(out, header, rows)
+	}
+	return printTable(out, header, rows)
+}
+
+func printRound(ctx context.Context, id string, format string, out io.Writer) error {
+	round, err := loadRound(ctx, id)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(out, apiRound(round))
+	}
+	header := []string{"session", "player", "winner", "card", "text"}
+	rows := [][]string{{round.JudgeSessionId, round.Judge, "", "black", round.BlackCard.Text}}
+	for _, play := range round.Plays {
+		for i, card := range play.Cards {
+			rows = append(rows, []string{play.SessionId, play.Player, strconv.FormatBool(play.Winner),
+				strconv.Itoa(i + 1), card.Text})
+		}
+	}
+	return printRows(format, out, header, rows)
+}
+
+func roundRows(rounds []model.RoundMeta) [][]string {
+	rows := [][]string{}
+	for _, round := range rounds {
+		rows = append(rows, []string{round.RoundId, round.FormattedTimestamp(), round.BlackCard.Text})
+	}
+	return rows
+}
+
+func printGame(ctx context.Context, id string, format string, out io.Writer) error {
+	game, err := loadGame(ctx, id)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(out, apiGame(game))
+	}
+	return printRows(format, out, []string{"round", "time", "black card"}, roundRows(game.Rounds))
+}
+
+func printSession(ctx context.Context, id string, format string, out io.Writer) error {
+	session, err := loadSession(ctx, id)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(out, apiSession(id, session))
+	}
+	rows := [][]string{}
+	for _, game := range session.Games {
+		rows = append(rows, []string{"game", game.GameId, game.FormattedTimestamp(), ""})
+	}
+	for _, row := range roundRows(session.PlayedRounds) {
+		rows = append(rows, append([]string{"played"}, row...))
+	}
+	for _, row := range roundRows(session.JudgedRounds) {
+		rows = append(rows, append([]string{"judged"}, row...))
+	}
+	return printRows(format, out, []string{"kind", "id", "time", "black card"}, rows)
+}
+
+func printUser(ctx context.Context, id string, format string, out io.Writer) error {
+	user, err := loadUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return printJSON(out, apiUser(id, user))
+	}
+	rows := [][]string{}
+	for _, session := range user.Sessions {
+		rows = append(rows, []string{session.SessionId, session.ServerId(), session.FormattedTimestamp()})
+	}
+	return printRows(format, out, []string{"session", "server", "time"}, rows)
+}
+
+func printDeck(ctx context.Context, id string, format string, out io.Writer) error {
+	deck, err := loadDeck(ctx, strings.ToUpper(id), model.DeckFilter{})
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json":
+		return printJSON(out, apiDeck(deck))
+	case "csv":
+		// exactly the same as the download from the deck page
+		return csvTemplate.ExecuteTemplate(out, "deck_csv", deck)
+	}
+	fmt.Fprintf(out, "%s (%s): %d of %d white cards and %d of %d black cards retrieved\n\n", deck.Name,
+		deck.ID, len(deck.WhiteCards), deck.WhiteCount, len(deck.BlackCards), deck.BlackCount)
+	rows := [][]string{}
+	for _, card := range deck.BlackCards {
+		rows = append(rows, []string{"black", strconv.Itoa(int(card.Meta.Pick)),
+			strconv.Itoa(int(card.Meta.Draw)), card.Text})
+	}
+	for _, card := range deck.WhiteCards {
+		rows = append(rows, []string{"white", "", "", card.Text})
+	}
+	return printTable(out, []string{"color", "pick", "draw", "text"}, rows)
+}
+
+// runHashPasswordCommand reads a password from stdin and prints the hash to put in an admin user's
+// passwordhash.
+func runHashPasswordCommand() int {
+	fmt.Fprintln(os.Stderr, "Password:")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		if err != nil && err != io.EOF {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			fmt.Fprintln(os.Stderr, "The password can't be empty.")
+		}
+		return 1
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(hash))
+	return 0
+}
+
+// runNewTokenCommand makes up a bearer token for an admin user, and prints it along with the hash to
+// put in their tokenhash.
+func runNewTokenCommand() int {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	encoded := hex.EncodeToString(token)
+	hash := sha256.Sum256([]byte(encoded))
+	fmt.Printf("token:     %s\ntokenhash: %s\n", encoded, hex.EncodeToString(hash[:]))
+	return 0
+}
+
+// runSignUserLinkCommand prints a signed link to a user's page, the same as the PYX server would
+// give out.
+func runSignUserLinkCommand(configPath string, args []string) int {
+	flags := flag.NewFlagSet("sign-user-link", flag.ContinueOnError)
+	expiresIn := flags.Duration("expires", 0, "How long the link works for, or 0 for it to never expire")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s sign-user-link <persistent id> [--expires duration]\n", os.Args[0])
+		return 2
+	}
+	config = loadConfig(configPath, []string{})
+	if !userLinksSigned() {
+		fmt.Fprintln(os.Stderr, "There's no userlinkkey in the privacy config, so user links don't need signing.")
+		return 1
+	}
+	id := flags.Arg(0)
+	if err := validateId("persistent", id); err != nil {
+		fmt.Fprintln(os.Stderr, publicDetail(err))
+		return 1
+	}
+	query := url.Values{}
+	expires := ""
+	if *expiresIn > 0 {
+		expires = strconv.FormatInt(time.Now().Add(*expiresIn).Unix(), 10)
+		query.Set("expires", expires)
+	}
+	query.Set("sig", userLinkSignature(id, expires))
+	fmt.Printf("/user/%s?%s\n", url.PathEscape(id), query.Encode())
+	return 0
+}
@@ -0,0 +1,188 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package client is a Go client for the viewer's /api/v1 routes.
+//
+//	c := client.New("https://metrics.example.com")
+//	round, err := c.GetRound(ctx, roundId)
+//	if errors.Is(err, client.ErrNotFound) {
+//		...
+//	}
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/api"
+)
+
+type Client struct {
+	// BaseURL is where the viewer is, without /api/v1.
+	BaseURL    string
+	HTTPClient *http.Client
+	// MaxRetries is how many times to retry a request which failed because the viewer or its
+	// database was unavailable or took too long. Requests which fail for any other reason are
+	// never retried.
+	MaxRetries int
+	// RetryWait is how long to wait before the first retry. It doubles after each one.
+	RetryWait time.Duration
+	// PlainText asks for card text without any markup, instead of as HTML.
+	PlainText bool
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+		MaxRetries: 3,
+		RetryWait:  500 * time.Millisecond,
+	}
+}
+
+func (c *Client) GetRound(ctx context.Context, id string) (*api.Round, error) {
+	ret := &api.Round{}
+	return ret, c.getJSON(ctx, "/rounds/"+url.PathEscape(id), ret)
+}
+
+func (c *Client) GetGame(ctx context.Context, id string) (*api.Game, error) {
+	ret := &api.Game{}
+	return ret, c.getJSON(ctx, "/games/"+url.PathEscape(id), ret)
+}
+
+func (c *Client) GetSession(ctx context.Context, id string) (*api.Session, error) {
+	ret := &api.Session{}
+	return ret, c.getJSON(ctx, "/sessions/"+url.PathEscape(id), ret)
+}
+
+func (c *Client) GetSessionStats(ctx context.Context, id string) (*api.SessionStats, error) {
+	ret := &api.SessionStats{}
+	return ret, c.getJSON(ctx, "/sessions/"+url.PathEscape(id)+"/stats", ret)
+}
+
+func (c *Client) GetUser(ctx context.Context, persistentId string) (*api.User, error) {
+	ret := &api.User{}
+	return ret, c.getJSON(ctx, "/users/"+url.PathEscape(persistentId), ret)
+}
+
+// GetSignedUser is GetUser with a signed link from the PYX server, for viewers that need one. expires
+// is empty if the link doesn't expire.
+func (c *Client) GetSignedUser(ctx context.Context, persistentId string, expires string, sig string) (*api.User, error) {
+	query := url.Values{"sig": {sig}}
+	if expires != "" {
+		query.Set("expires", expires)
+	}
+	ret := &api.User{}
+	return ret, c.getJSON(ctx, "/users/"+url.PathEscape(persistentId)+"?"+query.Encode(), ret)
+}
+
+func (c *Client) GetDeck(ctx context.Context, code string) (*api.Deck, error) {
+	ret := &api.Deck{}
+	return ret, c.getJSON(ctx, "/decks/"+url.PathEscape(code), ret)
+}
+
+// DownloadDeck returns the deck as a CSV file.
+func (c *Client) DownloadDeck(ctx context.Context, code string) ([]byte, error) {
+	return c.get(ctx, "/decks/"+url.PathEscape(code)+"/download", "text/csv")
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	if c.PlainText {
+		if strings.Contains(path, "?") {
+			path += "&text=plain"
+		} else {
+			path += "?text=plain"
+		}
+	}
+	body, err := c.get(ctx, path, "application/json")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (c *Client) get(ctx context.Context, path string, accept string) ([]byte, error) {
+	wait := c.RetryWait
+	for attempt := 0; ; attempt++ {
+		body, err := c.getOnce(ctx, path, accept)
+		if err == nil || attempt >= c.MaxRetries || !retryable(err) {
+			return body, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func (c *Client) getOnce(ctx context.Context, path string, accept string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.BaseURL+api.Version+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", accept)
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &transportError{err}
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &transportError{err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+// transportError is a failure to talk to the viewer at all, rather than an error from it.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return fmt.Sprintf("unable to reach viewer: %v", e.err)
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,118 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ajanata/pyx-metrics-viewer/api"
+)
+
+// These match the kinds of problem the viewer reports, so callers can check for them with
+// errors.Is.
+var (
+	ErrInternal     = errors.New("internal error")
+	ErrNotFound     = errors.New("not found")
+	ErrBadId        = errors.New("invalid ID")
+	ErrBadRequest   = errors.New("bad request")
+	ErrRemoved      = errors.New("removed")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrRateLimited  = errors.New("too many requests")
+	ErrUnavailable  = errors.New("database unavailable")
+	ErrTimeout      = errors.New("database timeout")
+)
+
+var problemTypes = map[string]error{
+	api.ProblemInternal:     ErrInternal,
+	api.ProblemNotFound:     ErrNotFound,
+	api.ProblemBadId:        ErrBadId,
+	api.ProblemBadRequest:   ErrBadRequest,
+	api.ProblemRemoved:      ErrRemoved,
+	api.ProblemUnauthorized: ErrUnauthorized,
+	api.ProblemForbidden:    ErrForbidden,
+	api.ProblemRateLimited:  ErrRateLimited,
+	api.ProblemUnavailable:  ErrUnavailable,
+	api.ProblemTimeout:      ErrTimeout,
+}
+
+// For responses that didn't come with problem details, e.g. from a proxy in front of the viewer.
+var statusKinds = map[int]error{
+	http.StatusBadRequest:         ErrBadId,
+	http.StatusUnauthorized:       ErrUnauthorized,
+	http.StatusForbidden:          ErrForbidden,
+	http.StatusNotFound:           ErrNotFound,
+	http.StatusGone:               ErrRemoved,
+	http.StatusTooManyRequests:    ErrRateLimited,
+	http.StatusBadGateway:         ErrUnavailable,
+	http.StatusServiceUnavailable: ErrUnavailable,
+	http.StatusGatewayTimeout:     ErrTimeout,
+}
+
+// Error is an error response from the viewer.
+type Error struct {
+	StatusCode int
+	// Problem is what the viewer said went wrong. If the response didn't have problem details,
+	// only Status and Title are filled in.
+	Problem api.Problem
+	kind    error
+}
+
+func newError(status int, body []byte) *Error {
+	e := &Error{StatusCode: status}
+	if json.Unmarshal(body, &e.Problem) != nil || e.Problem.Type == "" {
+		e.Problem = api.Problem{
+			Status: status,
+			Title:  http.StatusText(status),
+		}
+	}
+	if kind, ok := problemTypes[e.Problem.Type]; ok {
+		e.kind = kind
+	} else if kind, ok := statusKinds[status]; ok {
+		e.kind = kind
+	} else {
+		e.kind = ErrInternal
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Problem.Detail != "" {
+		return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Problem.Title, e.Problem.Detail)
+	}
+	return fmt.Sprintf("%d %s", e.StatusCode, e.Problem.Title)
+}
+
+// Is lets errors.Is match an Error against ErrNotFound and friends.
+func (e *Error) Is(target error) bool {
+	return target == e.kind
+}
+
+func retryable(err error) bool {
+	var te *transportError
+	return errors.As(err, &te) || errors.Is(err, ErrUnavailable) || errors.Is(err, ErrTimeout)
+}
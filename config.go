@@ -24,6 +24,8 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/koding/multiconfig"
 )
 
@@ -32,17 +34,149 @@ type DbConfig struct {
 	Password string `required:"true"`
 	DbName   string `required:"true"`
 	Host     string
+	// QueryTimeout is how long, in seconds, to wait for a query before giving up.
+	QueryTimeout int
+}
+
+type GraphQLConfig struct {
+	// MaxDepth is how deeply fields can be nested in a query.
+	MaxDepth int
+	// MaxComplexity is how many fields a query can resolve, assuming every list has ListCost items.
+	MaxComplexity int
+	ListCost      int
+}
+
+type RatingsConfig struct {
+	// UpdateInterval is how often, in seconds, to rate the rounds that have finished since last time.
+	UpdateInterval int
+	// KFactor is the most a card's rating can change in one round.
+	KFactor float64
+	// MinRounds is how many rounds a card has to have been played in to be on a leaderboard.
+	MinRounds int
+	// BatchSize is how many rounds to load at once.
+	BatchSize int
+}
+
+type TopConfig struct {
+	// MinPlays is how many times a white card has to have been played to be on the win rate list.
+	MinPlays int
+	// ListedUsers are the persistent IDs that have asked to be on the most active list. Nobody else
+	// is ever shown on it.
+	ListedUsers []string
+}
+
+type SearchConfig struct {
+	// Mode is how card text is matched: "fulltext" for Postgres full-text search, "trigram" for
+	// pg_trgm similarity, or "substring" for a plain case-insensitive match that works anywhere.
+	Mode string
+}
+
+type FilterConfig struct {
+	// Rules are what card text is filtered for, each written as type:pattern. The types are
+	// substring (ignoring case), regex, and domain (a domain or its subdomains, in anything that
+	// looks like a URL), and "url" on its own filters any URL.
+	Rules []string
+	// Allow are exceptions to the rules, written the same way. Text matching a rule is let through
+	// if it's entirely inside something that matches one of these.
+	Allow []string
+	// Mode is "card" to replace the whole card when any of it is filtered, or "redact" to replace
+	// only the text that matched.
+	Mode string
+}
+
+type ReportsConfig struct {
+	// PerHour is how many reports can be made from one address in an hour.
+	PerHour int
+	// TrustedProxies are the addresses of reverse proxies in front of the viewer. The address a
+	// report is from is only taken from X-Forwarded-For when the request came through one of them.
+	TrustedProxies []string
+}
+
+type PrivacyConfig struct {
+	// UserLinkKey is shared with the PYX server, which signs links to user pages with it. If it's
+	// set, user pages can only be reached with a signed link, and nothing leads from a session to
+	// its persistent ID.
+	UserLinkKey string
+	// OptOut are the persistent IDs of users who don't want their play history shown.
+	OptOut []string
+	// OptOutMode is "hide" to act as if their sessions don't exist, or "aggregate" to only show how
+	// many rounds each session played and judged.
+	OptOutMode string
+	// RedactSessionIds leaves out which session made each play and judged each round.
+	RedactSessionIds bool
+}
+
+type AdminUserConfig struct {
+	Name string
+	// PasswordHash is a bcrypt hash of the user's password, if they can log in with one.
+	PasswordHash string
+	// TokenHash is the SHA-256 of the user's bearer token in hex, if they can use one.
+	TokenHash string
+	// Roles are what the user can do: moderator, operator, or both.
+	Roles []string
+}
+
+type AdminConfig struct {
+	// Users are everyone who can use the admin pages. There are no admin pages without any.
+	Users []AdminUserConfig
+	// ProxyHeader is a header set by a reverse proxy in front of the viewer to the name of the user
+	// it has logged in. It must not be possible to reach the viewer without going through the proxy.
+	ProxyHeader string
+}
+
+type DeckServiceConfig struct {
+	Name string
+	// Prefix comes before the code in URLs, to tell the service's decks apart from Cardcast's.
+	Prefix string
+	// Length is how many characters the service's codes are.
+	Length int
+	// Offset is added to the decoded code before it's negated to get the id in the deck table.
+	Offset int64
+}
+
+type DecksConfig struct {
+	// Builtin are the watermarks of the built-in decks, by their id in the deck table. Built-in decks
+	// that aren't here are still found by their id, but without a watermark their cards can't be.
+	Builtin map[string]string
+	// Services are deck-hosting services other than Cardcast that use the same kind of codes.
+	Services []DeckServiceConfig
 }
 
 type Config struct {
-	Database       DbConfig
+	Database DbConfig
+	GraphQL  GraphQLConfig
+	Ratings  RatingsConfig
+	Top      TopConfig
+	Search   SearchConfig
+	Decks    DecksConfig
+	Filter   FilterConfig
+	Reports  ReportsConfig
+	Admin    AdminConfig
+	Privacy  PrivacyConfig
+	// Watermarks are names for decks by their watermarks, for decks that aren't in the deck table or
+	// to override what's there, like the built-in decks.
+	Watermarks map[string]string
+	// DataDir is where the viewer keeps the things it works out for itself.
+	DataDir        string
 	LogLevel       string
 	RunDebugServer bool
-	FilteredText   []string `required:"true"`
+	// FilteredText is the old way of filtering cards. Each entry is treated as a substring rule.
+	FilteredText []string
 }
 
-func loadConfig() *Config {
-	m := multiconfig.NewWithPath("pyx-metrics-viewer.toml")
+const defaultConfigPath = "pyx-metrics-viewer.toml"
+
+// loadConfig loads the configuration from the TOML file at path, then the environment, then flags.
+func loadConfig(path string, flags []string) *Config {
+	m := &multiconfig.DefaultLoader{
+		Loader: multiconfig.MultiLoader(
+			&multiconfig.TagLoader{},
+			&multiconfig.TOMLLoader{Path: path},
+			&multiconfig.EnvironmentLoader{},
+			&multiconfig.FlagLoader{Args: flags},
+		),
+		Validator: multiconfig.MultiValidator(&multiconfig.RequiredValidator{}),
+	}
 	c := new(Config)
 	m.MustLoad(c)
 	c.ensureDefaults()
@@ -52,10 +186,82 @@ func loadConfig() *Config {
 
 func (c *Config) ensureDefaults() {
 	c.Database.ensureDbDefaults()
+	c.GraphQL.ensureGraphQLDefaults()
+	c.Ratings.ensureRatingsDefaults()
+	if c.Top.MinPlays <= 0 {
+		c.Top.MinPlays = 20
+	}
+	if c.Search.Mode == "" {
+		c.Search.Mode = "fulltext"
+	}
+	if c.Reports.PerHour <= 0 {
+		c.Reports.PerHour = 10
+	}
+	if c.Filter.Mode == "" {
+		c.Filter.Mode = "card"
+	}
+	if c.Privacy.OptOutMode == "" {
+		c.Privacy.OptOutMode = "hide"
+	}
+	if c.DataDir == "" {
+		c.DataDir = "data"
+	}
 }
 
 func (config *DbConfig) ensureDbDefaults() {
 	if config.Host == "" {
 		config.Host = "localhost"
 	}
+	if config.QueryTimeout <= 0 {
+		config.QueryTimeout = 30
+	}
+}
+
+func (config *GraphQLConfig) ensureGraphQLDefaults() {
+	if config.MaxDepth <= 0 {
+		config.MaxDepth = 8
+	}
+	if config.MaxComplexity <= 0 {
+		config.MaxComplexity = 20000
+	}
+	if config.ListCost <= 0 {
+		config.ListCost = 5
+	}
+}
+
+func (config *RatingsConfig) ensureRatingsDefaults() {
+	if config.UpdateInterval <= 0 {
+		config.UpdateInterval = 300
+	}
+	if config.KFactor <= 0 {
+		config.KFactor = 32
+	}
+	if config.MinRounds <= 0 {
+		config.MinRounds = 10
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1000
+	}
+}
+
+// configFlag pulls --config out of the arguments, leaving the rest for the server or a command to
+// deal with.
+func configFlag(args []string) (string, []string) {
+	path := defaultConfigPath
+	rest := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-config" || arg == "--config":
+			if i+1 < len(args) {
+				path = args[i+1]
+				i++
+			}
+		case strings.HasPrefix(arg, "-config=") || strings.HasPrefix(arg, "--config="):
+			path = arg[strings.Index(arg, "=")+1:]
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return path, rest
 }
@@ -0,0 +1,114 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Helpers for the files the viewer keeps in its data directory.
+
+func dataPath(name string) string {
+	return filepath.Join(config.DataDir, name)
+}
+
+// readJSONFile reads a file in the data directory into v. It isn't an error for the file not to
+// exist, in which case v is left alone.
+func readJSONFile(name string, v interface{}) error {
+	data, err := ioutil.ReadFile(dataPath(name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s is not valid: %v", dataPath(name), err)
+	}
+	return nil
+}
+
+// writeJSONFile replaces a file in the data directory with v, so that anything reading it sees
+// either the old version or the new one.
+func writeJSONFile(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(config.DataDir, 0755); err != nil {
+		return err
+	}
+	tmp := dataPath(name) + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dataPath(name))
+}
+
+// appendJSONLine adds v to the end of a file in the data directory, on a line of its own.
+func appendJSONLine(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(config.DataDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dataPath(name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// loadOrCreateKey loads a secret key from the data directory, making a new one the first time.
+func loadOrCreateKey(name string) ([]byte, error) {
+	key, err := ioutil.ReadFile(dataPath(name))
+	if err == nil {
+		if len(key) < 32 {
+			return nil, fmt.Errorf("%s is too short to be a key", dataPath(name))
+		}
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(config.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	log.Infof("Creating a new key in %s.", dataPath(name))
+	return key, ioutil.WriteFile(dataPath(name), key, 0600)
+}
@@ -25,30 +25,37 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/ajanata/pyx-metrics-viewer/model"
 	"github.com/gin-gonic/gin"
 )
 
 var getDeckInfo *sql.Stmt
 var getWhiteCards *sql.Stmt
 var getBlackCards *sql.Stmt
-var csvTemplate = template.Must(template.ParseFiles("templates/deck.csv"))
+var getWhiteCardCount *sql.Stmt
+var getBlackCardCount *sql.Stmt
+var getDeckVersions *sql.Stmt
+var getDeckCardsFirstPlayed *sql.Stmt
+var getDeckPlayStats *sql.Stmt
+var getDeckUsage *sql.Stmt
+var getDeckCardStats *sql.Stmt
 
-type Deck struct {
-	Name       string
-	ID         string
-	WhiteCount int
-	BlackCount int
-	WhiteCards []Card
-	BlackCards []Card
-}
+// how many of the best and worst cards to show on a deck's stats
+const deckStatsCards = 10
+
+// how many times a card has to have been played to be one of a deck's best or worst
+const deckStatsMinPlays = 5
+
+var csvTemplate = template.Must(template.ParseFiles("templates/deck.csv"))
 
 type deckHandler struct{}
 
@@ -61,117 +68,398 @@ func (h deckHandler) registerEndpoints(r *gin.Engine) {
 	log.Debug("Registering endpoints for deck handler")
 	r.GET("/deck/:id", getDeck)
 	r.GET("/deck/:id/download", downloadDeck)
+	r.GET("/deck/:id/history", getDeckHistory)
+	r.GET("/deck/:id/stats", getDeckStats)
 }
 
 func (h deckHandler) prepareStatements(db *sql.DB) error {
 	log.Debug("Preparing statements for deck handler")
 	var err error
+	deckIdResolvers, err = newDeckIdResolvers(config.Decks)
+	if err != nil {
+		return err
+	}
 	getDeckInfo, err = db.Prepare(`
     SELECT "name", white_count, black_count FROM deck WHERE id = $1 ORDER BY uid DESC LIMIT 1
 `)
 	if err != nil {
 		return err
 	}
+	// $2 is text to look for, $3 is how to sort them, and for black cards, $4 and $5 are the pick and
+	// draw to look for, or 0 for any. The last two are the LIMIT, or NULL for all of them, and OFFSET.
+	// How many times each card was used is only counted when sorting by it, and is NULL otherwise.
 	getWhiteCards, err = db.Prepare(`
-    SELECT text FROM white_card WHERE watermark = $1
+    SELECT uid, text, uses FROM (
+      SELECT wc.uid, wc.text,
+        CASE WHEN $3 = 'usage' THEN
+          (SELECT COUNT(*) FROM round_complete__user_session__white_card jt WHERE jt.white_card_uid = wc.uid)
+        END uses
+      FROM white_card wc
+      WHERE wc.watermark = $1 AND strpos(lower(wc.text), lower($2)) > 0
+    ) c
+    ORDER BY CASE WHEN $3 = 'usage' THEN uses END DESC, CASE WHEN $3 = 'text' THEN lower(text) END, uid
+    LIMIT $4 OFFSET $5
 `)
 	if err != nil {
 		return err
 	}
 	getBlackCards, err = db.Prepare(`
-    SELECT text, draw, pick FROM black_card WHERE watermark = $1
+    SELECT uid, text, draw, pick, uses FROM (
+      SELECT bc.uid, bc.text, bc.draw, bc.pick,
+        CASE WHEN $3 = 'usage' THEN
+          (SELECT COUNT(*) FROM round_complete rc WHERE rc.black_card_uid = bc.uid)
+        END uses
+      FROM black_card bc
+      WHERE bc.watermark = $1 AND strpos(lower(bc.text), lower($2)) > 0
+        AND ($4 = 0 OR bc.pick = $4) AND ($5 = 0 OR bc.draw = $5)
+    ) c
+    ORDER BY CASE WHEN $3 = 'usage' THEN uses END DESC, CASE WHEN $3 = 'text' THEN lower(text) END, uid
+    LIMIT $6 OFFSET $7
+`)
+	if err != nil {
+		return err
+	}
+	// how many cards the two above would return without a LIMIT, for working out the pages
+	getWhiteCardCount, err = db.Prepare(`
+    SELECT COUNT(*) FROM white_card wc
+    WHERE wc.watermark = $1 AND strpos(lower(wc.text), lower($2)) > 0
+`)
+	if err != nil {
+		return err
+	}
+	getBlackCardCount, err = db.Prepare(`
+    SELECT COUNT(*) FROM black_card bc
+    WHERE bc.watermark = $1 AND strpos(lower(bc.text), lower($2)) > 0
+      AND ($3 = 0 OR bc.pick = $3) AND ($4 = 0 OR bc.draw = $4)
+`)
+	if err != nil {
+		return err
+	}
+	getDeckVersions, err = db.Prepare(`
+    SELECT "name", white_count, black_count, ((meta).timestamp AT TIME ZONE 'UTC')
+    FROM deck WHERE id = $1 ORDER BY uid
+`)
+	if err != nil {
+		return err
+	}
+	// when each card with the watermark $1 was first played, which is the closest thing there is to
+	// when it was added to the deck
+	getDeckCardsFirstPlayed, err = db.Prepare(`
+    SELECT 'white', wc.uid, wc.text, 0, 0, MIN((rc.meta).timestamp AT TIME ZONE 'UTC') first_played
+    FROM white_card wc
+    JOIN round_complete__user_session__white_card jt ON jt.white_card_uid = wc.uid
+    JOIN round_complete rc ON rc.uid = jt.round_complete_uid
+    WHERE wc.watermark = $1
+    GROUP BY wc.uid, wc.text
+    UNION ALL
+    SELECT 'black', bc.uid, bc.text, bc.draw, bc.pick, MIN((rc.meta).timestamp AT TIME ZONE 'UTC') first_played
+    FROM black_card bc
+    JOIN round_complete rc ON rc.black_card_uid = bc.uid
+    WHERE bc.watermark = $1
+    GROUP BY bc.uid, bc.text, bc.draw, bc.pick
+    ORDER BY first_played
+`)
+	if err != nil {
+		return err
+	}
+	// Every play in every round that had one of the deck's white cards played in it, and whether the
+	// play had one of them in it. A play only needs one card from the deck to count as the deck's.
+	getDeckPlayStats, err = db.Prepare(`
+    WITH plays AS (
+      SELECT jt.round_complete_uid, jt.session_id, bool_or(wc.watermark = $1) ours,
+        bool_or(jt.session_id = rc.winner_session_id) won
+      FROM round_complete__user_session__white_card jt
+      JOIN white_card wc ON wc.uid = jt.white_card_uid
+      JOIN round_complete rc ON rc.uid = jt.round_complete_uid
+      WHERE jt.round_complete_uid IN (
+        SELECT djt.round_complete_uid
+        FROM round_complete__user_session__white_card djt
+        JOIN white_card dwc ON dwc.uid = djt.white_card_uid
+        WHERE dwc.watermark = $1
+      )
+      GROUP BY jt.round_complete_uid, jt.session_id
+    )
+    SELECT
+      (SELECT COUNT(*) FROM round_complete rc JOIN black_card bc ON bc.uid = rc.black_card_uid WHERE bc.watermark = $1),
+      COALESCE(SUM(CASE WHEN ours THEN 1 ELSE 0 END), 0),
+      COALESCE(SUM(CASE WHEN ours AND won THEN 1 ELSE 0 END), 0),
+      COALESCE(SUM(CASE WHEN NOT ours THEN 1 ELSE 0 END), 0),
+      COALESCE(SUM(CASE WHEN NOT ours AND won THEN 1 ELSE 0 END), 0)
+    FROM plays
+`)
+	if err != nil {
+		return err
+	}
+	getDeckUsage, err = db.Prepare(`
+    SELECT to_char(date_trunc('month', ts), 'YYYY-MM') month, SUM(black), SUM(white)
+    FROM (
+      SELECT ((rc.meta).timestamp AT TIME ZONE 'UTC') ts, 1 black, 0 white
+      FROM round_complete rc
+      JOIN black_card bc ON bc.uid = rc.black_card_uid
+      WHERE bc.watermark = $1
+      UNION ALL
+      SELECT ((rc.meta).timestamp AT TIME ZONE 'UTC') ts, 0 black, 1 white
+      FROM round_complete rc
+      JOIN (
+        SELECT DISTINCT jt.round_complete_uid, jt.session_id
+        FROM round_complete__user_session__white_card jt
+        JOIN white_card wc ON wc.uid = jt.white_card_uid
+        WHERE wc.watermark = $1
+      ) p ON p.round_complete_uid = rc.uid
+    ) usage
+    GROUP BY month
+    ORDER BY month
+`)
+	if err != nil {
+		return err
+	}
+	// $2 is how many times a card has to have been played.
+	getDeckCardStats, err = db.Prepare(`
+    SELECT wc.uid, wc.text, COUNT(*) plays, SUM(CASE WHEN jt.session_id = rc.winner_session_id THEN 1 ELSE 0 END) wins
+    FROM white_card wc
+    JOIN round_complete__user_session__white_card jt ON jt.white_card_uid = wc.uid
+    JOIN round_complete rc ON rc.uid = jt.round_complete_uid
+    WHERE wc.watermark = $1
+    GROUP BY wc.uid, wc.text
+    HAVING COUNT(*) >= $2
+    ORDER BY SUM(CASE WHEN jt.session_id = rc.winner_session_id THEN 1 ELSE 0 END)::float / COUNT(*) DESC, plays DESC, wc.uid
 `)
 	return err
 }
 
-func loadDeck(strID string) (Deck, int, error) {
-	if len(strID) != 5 {
-		return Deck{}, http.StatusBadRequest, errors.New("cardcast deck IDs must be 5 characters long")
+// how many cards are on a page of a deck, unless the client asks for something else
+const deckPageSize = 100
+
+// the most cards a client can ask for on one page
+const maxDeckPageSize = 500
+
+// parseDeckFilter gets a DeckFilter from the query string. If paged is false, every matching card
+// is on one page.
+func parseDeckFilter(c *gin.Context, paged bool) (model.DeckFilter, error) {
+	filter := model.DeckFilter{
+		Text:  strings.TrimSpace(c.Query("q")),
+		Color: c.Query("color"),
+		Sort:  c.Query("sort"),
+	}
+	if filter.Color != "" && filter.Color != "black" && filter.Color != "white" {
+		return model.DeckFilter{}, badRequestError("color must be black or white.")
 	}
-	// for cardcast, deck ID is the code converted to base 36 and then negated
-	id, err := strconv.ParseInt(strID, 36, 64)
-	if err != nil || id <= 0 {
-		return Deck{}, http.StatusBadRequest, errors.New("cardcast deck IDs must only contain letters and numbers")
+	if filter.Sort != "" && filter.Sort != "text" && filter.Sort != "usage" {
+		return model.DeckFilter{}, badRequestError("sort must be text or usage.")
+	}
+	var err error
+	if filter.Pick, err = parseDeckFilterNumber(c, "pick"); err != nil {
+		return model.DeckFilter{}, err
+	}
+	if filter.Draw, err = parseDeckFilterNumber(c, "draw"); err != nil {
+		return model.DeckFilter{}, err
+	}
+	if !paged {
+		return filter, nil
 	}
 
-	info, err := getDeckInfo.Query(-id)
-	if err == sql.ErrNoRows {
-		return Deck{}, http.StatusNotFound, errors.New("cardcast deck not found")
-	} else if err != nil {
-		return Deck{}, http.StatusInternalServerError, errors.New("could not load deck")
+	filter.Page = 1
+	filter.PageSize = deckPageSize
+	if page := c.Query("page"); page != "" {
+		if filter.Page, err = strconv.Atoi(page); err != nil || filter.Page < 1 {
+			return model.DeckFilter{}, badRequestError("page must be a positive number.")
+		}
+	}
+	if size := c.Query("size"); size != "" {
+		filter.PageSize, err = strconv.Atoi(size)
+		if err != nil || filter.PageSize < 1 || filter.PageSize > maxDeckPageSize {
+			return model.DeckFilter{}, badRequestError("size must be between 1 and %d.", maxDeckPageSize)
+		}
+	}
+	return filter, nil
+}
+
+func parseDeckFilterNumber(c *gin.Context, name string) (int16, error) {
+	value := c.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 16)
+	if err != nil || n < 0 {
+		return 0, badRequestError("%s must be a number.", name)
+	}
+	return int16(n), nil
+}
+
+// loadDeck counts the cards in a deck that match the filter, and loads the ones on the page it asks
+// for. Black cards come before white cards across the pages.
+func loadDeck(ctx context.Context, strID string, filter model.DeckFilter) (model.Deck, error) {
+	ref, err := resolveDeckId(strID)
+	if err != nil {
+		return model.Deck{}, err
+	}
+	if err = checkBlocked("deck", ref.Id); err != nil {
+		return model.Deck{}, err
+	}
+	id := ref.DbId
+
+	info, err := getDeckInfo.QueryContext(ctx, id)
+	if err != nil {
+		return model.Deck{}, dbError(err, "Could not load deck.")
 	}
 	defer info.Close()
 
 	if !info.Next() {
-		return Deck{}, http.StatusNotFound, errors.New("cardcast deck not found")
+		if info.Err() != nil {
+			return model.Deck{}, dbError(info.Err(), "Could not load deck.")
+		}
+		return model.Deck{}, notFoundError("Deck not found.")
 	}
 
 	var numWhite, numBlack int
 	var name string
 	err = info.Scan(&name, &numWhite, &numBlack)
 	if err != nil {
-		return Deck{}, http.StatusInternalServerError, errors.New("could not scan deck")
+		return model.Deck{}, dbError(err, "Could not scan deck.")
 	}
 
-	deck := Deck{
+	deck := model.Deck{
 		Name:       name,
-		ID:         strID,
+		ID:         ref.Id,
 		WhiteCount: numWhite,
 		BlackCount: numBlack,
+		Filter:     filter,
 	}
 
-	whites, err := getWhiteCards.Query(strID)
-	if err != nil {
-		return deck, http.StatusInternalServerError, errors.New("could not get white cards")
+	// pick and draw only mean anything for black cards, and there's no way to find the cards for a
+	// deck without knowing its watermark
+	withWhite := ref.Watermark != "" && filter.Color != "black" && filter.Pick == 0 && filter.Draw == 0
+	withBlack := ref.Watermark != "" && filter.Color != "white"
+	if withWhite {
+		err = getWhiteCardCount.QueryRowContext(ctx, ref.Watermark, filter.Text).Scan(&deck.MatchingWhite)
+		if err != nil {
+			return deck, dbError(err, "Could not count white cards.")
+		}
 	}
-	defer whites.Close()
-
-	for whites.Next() {
-		var text string
-		err := whites.Scan(&text)
+	if withBlack {
+		err = getBlackCardCount.QueryRowContext(ctx, ref.Watermark, filter.Text, filter.Pick, filter.Draw).
+			Scan(&deck.MatchingBlack)
 		if err != nil {
-			return deck, http.StatusInternalServerError, errors.New("could not scan white card")
+			return deck, dbError(err, "Could not count black cards.")
 		}
-		deck.WhiteCards = append(deck.WhiteCards, Card{
-			Text:      text,
-			Watermark: strID,
-			Meta:      CardMeta{Color: "white"},
-		})
 	}
+	countDeckPages(&deck)
 
-	blacks, err := getBlackCards.Query(strID)
-	if err != nil {
-		return deck, http.StatusInternalServerError, errors.New("could not get black cards")
+	if limit, offset, ok := deckPageRange(deck.Filter, 0, deck.MatchingBlack); ok {
+		blacks, err := getBlackCards.QueryContext(ctx, ref.Watermark, filter.Text, filter.Sort, filter.Pick, filter.Draw,
+			limit, offset)
+		if err != nil {
+			return deck, dbError(err, "Could not get black cards.")
+		}
+		defer blacks.Close()
+
+		for blacks.Next() {
+			var uid int64
+			var text string
+			var draw, pick int16
+			var uses sql.NullInt64
+			err := blacks.Scan(&uid, &text, &draw, &pick, &uses)
+			if err != nil {
+				return deck, dbError(err, "Could not scan black card.")
+			}
+			deck.BlackCards = append(deck.BlackCards, model.Card{
+				UID:       uid,
+				Text:      text,
+				Watermark: ref.Watermark,
+				Meta: model.CardMeta{
+					Color: "black",
+					Draw:  draw,
+					Pick:  pick,
+				},
+				Uses: int(uses.Int64),
+			})
+		}
+		if blacks.Err() != nil {
+			return deck, dbError(blacks.Err(), "Could not get black cards.")
+		}
+		filterCards(ctx, deck.BlackCards)
 	}
-	defer blacks.Close()
 
-	for blacks.Next() {
-		var text string
-		var draw, pick int16
-		err := blacks.Scan(&text, &draw, &pick)
+	if limit, offset, ok := deckPageRange(deck.Filter, deck.MatchingBlack, deck.MatchingWhite); ok {
+		whites, err := getWhiteCards.QueryContext(ctx, ref.Watermark, filter.Text, filter.Sort, limit, offset)
 		if err != nil {
-			return deck, http.StatusInternalServerError, errors.New("could not scan black card")
+			return deck, dbError(err, "Could not get white cards.")
 		}
-		deck.BlackCards = append(deck.BlackCards, Card{
-			Text:      text,
-			Watermark: strID,
-			Meta: CardMeta{
-				Color: "black",
-				Draw:  draw,
-				Pick:  pick,
-			},
-		})
+		defer whites.Close()
+
+		for whites.Next() {
+			var uid int64
+			var text string
+			var uses sql.NullInt64
+			err := whites.Scan(&uid, &text, &uses)
+			if err != nil {
+				return deck, dbError(err, "Could not scan white card.")
+			}
+			deck.WhiteCards = append(deck.WhiteCards, model.Card{
+				UID:       uid,
+				Text:      text,
+				Watermark: ref.Watermark,
+				Meta:      model.CardMeta{Color: "white"},
+				Uses:      int(uses.Int64),
+			})
+		}
+		if whites.Err() != nil {
+			return deck, dbError(whites.Err(), "Could not get white cards.")
+		}
+		filterCards(ctx, deck.WhiteCards)
 	}
 
-	return deck, 0, nil
+	return deck, nil
+}
+
+// countDeckPages works out how many pages the matching cards take up.
+func countDeckPages(deck *model.Deck) {
+	total := deck.MatchingBlack + deck.MatchingWhite
+	if deck.Filter.PageSize <= 0 {
+		deck.Pages = 1
+		deck.Filter.Page = 1
+		return
+	}
+	deck.Pages = (total + deck.Filter.PageSize - 1) / deck.Filter.PageSize
+	if deck.Pages == 0 {
+		deck.Pages = 1
+	}
+}
+
+// deckPageRange is the LIMIT and OFFSET for the part of the filter's page that's made up of cards of
+// one color, given how many cards of the other color come before them. ok is false if none of them
+// are on the page. A nil limit is every card, for when there's only one page.
+func deckPageRange(filter model.DeckFilter, before int, matching int) (limit interface{}, offset int, ok bool) {
+	if filter.PageSize <= 0 {
+		return nil, 0, matching > 0
+	}
+	start := (filter.Page-1)*filter.PageSize - before
+	end := start + filter.PageSize
+	if start < 0 {
+		start = 0
+	}
+	if end > matching {
+		end = matching
+	}
+	if start >= end {
+		return nil, 0, false
+	}
+	return end - start, start, true
 }
 
 func getDeck(c *gin.Context) {
 	strID := strings.ToUpper(c.Param("id"))
+	filter, err := parseDeckFilter(c, true)
+	if err != nil {
+		returnError(c, err)
+		return
+	}
 
-	deck, status, err := loadDeck(strID)
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	deck, err := loadDeck(ctx, strID, filter)
 	if err != nil {
-		returnError(c, status, err.Error())
+		returnError(c, err)
 		return
 	}
 
@@ -183,19 +471,240 @@ func getDeck(c *gin.Context) {
 }
 
 func downloadDeck(c *gin.Context) {
-	strID := c.Param("id")
+	sendDeckCsv(c, returnError)
+}
 
-	deck, status, err := loadDeck(strID)
+// sendDeckCsv sends a deck as a CSV file, with whatever kind of errors the caller reports.
+func sendDeckCsv(c *gin.Context, fail func(*gin.Context, error)) {
+	strID := strings.ToUpper(c.Param("id"))
+	// the download has the same cards as the page it was linked from, just all of them at once
+	filter, err := parseDeckFilter(c, false)
 	if err != nil {
-		returnError(c, status, err.Error())
+		fail(c, err)
+		return
+	}
+
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	deck, err := loadDeck(ctx, strID, filter)
+	if err != nil {
+		fail(c, err)
+		return
 	}
 
 	buf := &bytes.Buffer{}
 	err = csvTemplate.ExecuteTemplate(buf, "deck_csv", deck)
 	if err != nil {
-		returnError(c, http.StatusInternalServerError, "Could not prepare download")
+		fail(c, &viewerError{kind: errInternal, detail: "Could not prepare download.", cause: err})
 		return
 	}
-	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, strID))
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, deck.ID))
 	c.Data(http.StatusOK, "text/csv", buf.Bytes())
 }
+
+func getDeckHistory(c *gin.Context) {
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	history, err := loadDeckHistory(ctx, strings.ToUpper(c.Param("id")))
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(http.StatusOK, "deckhistory", &history)
+	} else {
+		c.JSON(http.StatusOK, history)
+	}
+}
+
+// loadDeckHistory loads every version of a deck that was recorded, and which cards showed up in
+// games while each one was the latest.
+func loadDeckHistory(ctx context.Context, strID string) (model.DeckHistory, error) {
+	ref, err := resolveDeckId(strID)
+	if err != nil {
+		return model.DeckHistory{}, err
+	}
+	if err = checkBlocked("deck", ref.Id); err != nil {
+		return model.DeckHistory{}, err
+	}
+	id := ref.DbId
+
+	rows, err := getDeckVersions.QueryContext(ctx, id)
+	if err != nil {
+		return model.DeckHistory{}, dbError(err, "Could not load deck history.")
+	}
+	defer rows.Close()
+
+	history := model.DeckHistory{ID: ref.Id, Versions: []model.DeckVersion{}}
+	for rows.Next() {
+		var name string
+		var numWhite, numBlack int
+		var timestamp time.Time
+		err = rows.Scan(&name, &numWhite, &numBlack, &timestamp)
+		if err != nil {
+			return model.DeckHistory{}, dbError(err, "Could not scan deck history.")
+		}
+
+		// the same version gets recorded every time the deck is loaded, so only start a new one when
+		// something actually changed
+		n := len(history.Versions)
+		if n > 0 {
+			last := &history.Versions[n-1]
+			if last.Name == name && last.WhiteCount == numWhite && last.BlackCount == numBlack {
+				last.LastSeen = timestamp.Unix()
+				last.Loads++
+				continue
+			}
+		}
+		version := model.DeckVersion{
+			Name:       name,
+			WhiteCount: numWhite,
+			BlackCount: numBlack,
+			FirstSeen:  timestamp.Unix(),
+			LastSeen:   timestamp.Unix(),
+			Loads:      1,
+			NewCards:   []model.Card{},
+		}
+		if n > 0 {
+			version.WhiteChange = numWhite - history.Versions[n-1].WhiteCount
+			version.BlackChange = numBlack - history.Versions[n-1].BlackCount
+		}
+		history.Versions = append(history.Versions, version)
+	}
+	if rows.Err() != nil {
+		return model.DeckHistory{}, dbError(rows.Err(), "Could not load deck history.")
+	}
+	rows.Close()
+	if len(history.Versions) == 0 {
+		return model.DeckHistory{}, notFoundError("Deck not found.")
+	}
+
+	if ref.Watermark == "" {
+		return history, nil
+	}
+	cards, err := getDeckCardsFirstPlayed.QueryContext(ctx, ref.Watermark)
+	if err != nil {
+		return model.DeckHistory{}, dbError(err, "Could not get cards.")
+	}
+	defer cards.Close()
+
+	// Cards are in the order they were first played, so walk forward through the versions alongside
+	// them. Anything played before the first recorded version goes with the first version.
+	current := 0
+	for cards.Next() {
+		card := model.Card{Watermark: ref.Watermark}
+		var firstPlayed time.Time
+		err = cards.Scan(&card.Meta.Color, &card.UID, &card.Text, &card.Meta.Draw, &card.Meta.Pick, &firstPlayed)
+		if err != nil {
+			return model.DeckHistory{}, dbError(err, "Could not scan card.")
+		}
+		filterCard(ctx, &card)
+		for current+1 < len(history.Versions) && history.Versions[current+1].FirstSeen <= firstPlayed.Unix() {
+			current++
+		}
+		history.Versions[current].NewCards = append(history.Versions[current].NewCards, card)
+	}
+	if cards.Err() != nil {
+		return model.DeckHistory{}, dbError(cards.Err(), "Could not get cards.")
+	}
+
+	return history, nil
+}
+
+func getDeckStats(c *gin.Context) {
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	stats, err := loadDeckStats(ctx, strings.ToUpper(c.Param("id")))
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(http.StatusOK, "deckstats", &stats)
+	} else {
+		c.JSON(http.StatusOK, stats)
+	}
+}
+
+// loadDeckStats works out how much a deck was used, going by the watermarks on the cards that were
+// played.
+func loadDeckStats(ctx context.Context, strID string) (model.DeckStats, error) {
+	ref, err := resolveDeckId(strID)
+	if err != nil {
+		return model.DeckStats{}, err
+	}
+	if err = checkBlocked("deck", ref.Id); err != nil {
+		return model.DeckStats{}, err
+	}
+	id := ref.DbId
+
+	stats := model.DeckStats{
+		ID:         ref.Id,
+		Usage:      []model.DeckUsage{},
+		MinPlays:   deckStatsMinPlays,
+		BestCards:  []model.TopWhiteCard{},
+		WorstCards: []model.TopWhiteCard{},
+	}
+	var numWhite, numBlack int
+	err = getDeckInfo.QueryRowContext(ctx, id).Scan(&stats.Name, &numWhite, &numBlack)
+	if err == sql.ErrNoRows {
+		return model.DeckStats{}, notFoundError("Deck not found.")
+	} else if err != nil {
+		return model.DeckStats{}, dbError(err, "Could not load deck.")
+	}
+
+	if ref.Watermark == "" {
+		return stats, nil
+	}
+	err = getDeckPlayStats.QueryRowContext(ctx, ref.Watermark).Scan(&stats.BlackRounds, &stats.WhitePlays, &stats.WhiteWins,
+		&stats.OtherPlays, &stats.OtherWins)
+	if err != nil {
+		return model.DeckStats{}, dbError(err, "Could not load deck usage.")
+	}
+
+	usage, err := getDeckUsage.QueryContext(ctx, ref.Watermark)
+	if err != nil {
+		return model.DeckStats{}, dbError(err, "Could not load deck usage.")
+	}
+	defer usage.Close()
+	for usage.Next() {
+		month := model.DeckUsage{}
+		err = usage.Scan(&month.Month, &month.BlackRounds, &month.WhitePlays)
+		if err != nil {
+			return model.DeckStats{}, dbError(err, "Could not scan deck usage.")
+		}
+		stats.Usage = append(stats.Usage, month)
+	}
+	if usage.Err() != nil {
+		return model.DeckStats{}, dbError(usage.Err(), "Could not load deck usage.")
+	}
+	usage.Close()
+
+	cards, err := getDeckCardStats.QueryContext(ctx, ref.Watermark, deckStatsMinPlays)
+	if err != nil {
+		return model.DeckStats{}, dbError(err, "Could not load card stats.")
+	}
+	defer cards.Close()
+	ranked := []model.TopWhiteCard{}
+	for cards.Next() {
+		card := model.TopWhiteCard{Card: model.Card{Watermark: ref.Watermark, Meta: model.CardMeta{Color: "white"}}}
+		err = cards.Scan(&card.Card.UID, &card.Card.Text, &card.Plays, &card.Wins)
+		if err != nil {
+			return model.DeckStats{}, dbError(err, "Could not scan card stats.")
+		}
+		filterCard(ctx, &card.Card)
+		ranked = append(ranked, card)
+	}
+	if cards.Err() != nil {
+		return model.DeckStats{}, dbError(cards.Err(), "Could not load card stats.")
+	}
+
+	// the worst are the best backwards, and a small deck can have the same cards in both
+	for i := 0; i < len(ranked) && i < deckStatsCards; i++ {
+		stats.BestCards = append(stats.BestCards, ranked[i])
+		stats.WorstCards = append(stats.WorstCards, ranked[len(ranked)-1-i])
+	}
+	return stats, nil
+}
@@ -0,0 +1,238 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// resolvedDeck is what a deck ID points to: its row in the deck table, and the watermark on its
+// cards.
+type resolvedDeck struct {
+	// Id is how the deck is written in URLs.
+	Id   string
+	DbId int64
+	// Watermark is empty if it isn't known, in which case the deck's cards can't be found.
+	Watermark string
+}
+
+// deckIdResolver understands one way of writing deck IDs.
+type deckIdResolver interface {
+	// parse returns ok false if the ID isn't written this resolver's way.
+	parse(id string) (deck resolvedDeck, ok bool)
+	// fromDbId works out the deck for a row in the deck table, if it's one of this resolver's.
+	fromDbId(dbId int64) (deck resolvedDeck, ok bool)
+	// fromWatermark works out the deck for a card watermark, if it's one of this resolver's.
+	fromWatermark(watermark string) (deck resolvedDeck, ok bool)
+}
+
+// deckIdResolvers are tried in order, so more specific ones have to come first.
+var deckIdResolvers []deckIdResolver
+
+// rawDeckPrefix comes before an id from the deck table in URLs, for decks that no other resolver
+// knows and that aren't built-in decks written as a plain number. Without it, ids like 12345 would
+// be taken for Cardcast codes.
+const rawDeckPrefix = "ID:"
+
+// newDeckIdResolvers sets up the resolvers for the built-in decks, Cardcast, any other services in
+// the config, and finally raw ids in the deck table.
+func newDeckIdResolvers(config DecksConfig) ([]deckIdResolver, error) {
+	builtin := builtinDeckResolver{}
+	for strId, watermark := range config.Builtin {
+		id, err := strconv.ParseInt(strId, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("built-in deck id %s is not a positive number", strId)
+		}
+		builtin[id] = watermark
+	}
+
+	resolvers := []deckIdResolver{builtin, codeDeckResolver{name: "Cardcast", length: 5}}
+	for _, service := range config.Services {
+		if strings.HasPrefix(strings.ToUpper(service.Prefix), rawDeckPrefix) {
+			return nil, fmt.Errorf("deck service %s can't have a prefix starting with %s", service.Name, rawDeckPrefix)
+		}
+		// codes have to fit in an int64 once they're decoded
+		if service.Length <= 0 || service.Length > 12 {
+			return nil, fmt.Errorf("deck service %s has a code length of %d, which must be between 1 and 12",
+				service.Name, service.Length)
+		}
+		resolvers = append(resolvers, codeDeckResolver{
+			name:   service.Name,
+			prefix: strings.ToUpper(service.Prefix),
+			length: service.Length,
+			offset: service.Offset,
+		})
+	}
+	return append(resolvers, rawDeckResolver{}), nil
+}
+
+// resolveDeckId works out which deck an ID from a URL is for.
+func resolveDeckId(id string) (resolvedDeck, error) {
+	for _, resolver := range deckIdResolvers {
+		if deck, ok := resolver.parse(id); ok {
+			return deck, nil
+		}
+	}
+	return resolvedDeck{}, badIdError("'%s' is not a deck ID.", id)
+}
+
+// deckForWatermark works out which deck a card came from.
+func deckForWatermark(watermark string) (resolvedDeck, bool) {
+	for _, resolver := range deckIdResolvers {
+		if deck, ok := resolver.fromWatermark(watermark); ok {
+			return deck, true
+		}
+	}
+	return resolvedDeck{}, false
+}
+
+// builtinDeckResolver is for the built-in decks in the config, whose watermarks are known. Any other
+// built-in deck is found by rawDeckResolver.
+type builtinDeckResolver map[int64]string
+
+func (r builtinDeckResolver) parse(id string) (resolvedDeck, bool) {
+	dbId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return resolvedDeck{}, false
+	}
+	return r.fromDbId(dbId)
+}
+
+func (r builtinDeckResolver) fromDbId(dbId int64) (resolvedDeck, bool) {
+	watermark, ok := r[dbId]
+	if !ok {
+		return resolvedDeck{}, false
+	}
+	return resolvedDeck{Id: strconv.FormatInt(dbId, 10), DbId: dbId, Watermark: watermark}, true
+}
+
+func (r builtinDeckResolver) fromWatermark(watermark string) (resolvedDeck, bool) {
+	for dbId, builtin := range r {
+		if builtin == watermark {
+			return r.fromDbId(dbId)
+		}
+	}
+	return resolvedDeck{}, false
+}
+
+// codeDeckResolver is for deck-hosting services that identify decks with short base 36 codes, like
+// Cardcast did. The id in the deck table is the code decoded, plus offset, and then negated. Cards
+// are watermarked with the code, and in URLs the code comes after prefix.
+type codeDeckResolver struct {
+	name   string
+	prefix string
+	length int
+	offset int64
+}
+
+func (r codeDeckResolver) parse(id string) (resolvedDeck, bool) {
+	id = strings.ToUpper(id)
+	if !strings.HasPrefix(id, r.prefix) {
+		return resolvedDeck{}, false
+	}
+	return r.fromCode(id[len(r.prefix):])
+}
+
+func (r codeDeckResolver) fromCode(code string) (resolvedDeck, bool) {
+	if len(code) != r.length {
+		return resolvedDeck{}, false
+	}
+	n, err := strconv.ParseInt(code, 36, 64)
+	if err != nil || n <= 0 || strings.ContainsAny(code, "+-") {
+		return resolvedDeck{}, false
+	}
+	return resolvedDeck{Id: r.prefix + code, DbId: -(n + r.offset), Watermark: code}, true
+}
+
+func (r codeDeckResolver) fromDbId(dbId int64) (resolvedDeck, bool) {
+	n := -dbId - r.offset
+	if n <= 0 {
+		return resolvedDeck{}, false
+	}
+	code := strings.ToUpper(strconv.FormatInt(n, 36))
+	if len(code) > r.length {
+		return resolvedDeck{}, false
+	}
+	return r.fromCode(strings.Repeat("0", r.length-len(code)) + code)
+}
+
+func (r codeDeckResolver) fromWatermark(watermark string) (resolvedDeck, bool) {
+	return r.fromCode(strings.ToUpper(watermark))
+}
+
+// rawDeckResolver takes any id in the deck table after rawDeckPrefix, and the positive ids of
+// built-in decks on their own, as long as they can't be taken for another resolver's codes. If one
+// of the other resolvers knows the id, that one's used instead, so that it has a watermark.
+type rawDeckResolver struct{}
+
+func (rawDeckResolver) parse(id string) (resolvedDeck, bool) {
+	if strings.HasPrefix(strings.ToUpper(id), rawDeckPrefix) {
+		dbId, err := strconv.ParseInt(id[len(rawDeckPrefix):], 10, 64)
+		if err != nil {
+			return resolvedDeck{}, false
+		}
+		return rawDeckResolver{}.fromDbId(dbId)
+	}
+	// only written the way fromDbId would write it, so that +1 and 01 aren't decks
+	dbId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || dbId <= 0 || strconv.FormatInt(dbId, 10) != id {
+		return resolvedDeck{}, false
+	}
+	return rawDeckResolver{}.fromDbId(dbId)
+}
+
+func (rawDeckResolver) fromDbId(dbId int64) (resolvedDeck, bool) {
+	for _, resolver := range deckIdResolvers {
+		if _, raw := resolver.(rawDeckResolver); raw {
+			continue
+		}
+		if deck, ok := resolver.fromDbId(dbId); ok {
+			return deck, true
+		}
+	}
+	id := strconv.FormatInt(dbId, 10)
+	if dbId <= 0 || parsedByOthers(id) {
+		id = rawDeckPrefix + id
+	}
+	return resolvedDeck{Id: id, DbId: dbId}, true
+}
+
+// parsedByOthers is whether a resolver other than rawDeckResolver takes the ID.
+func parsedByOthers(id string) bool {
+	for _, resolver := range deckIdResolvers {
+		if _, raw := resolver.(rawDeckResolver); raw {
+			continue
+		}
+		if _, ok := resolver.parse(id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (rawDeckResolver) fromWatermark(string) (resolvedDeck, bool) {
+	return resolvedDeck{}, false
+}
@@ -0,0 +1,70 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package main
+
+import (
+	"testing"
+)
+
+func TestResolveDeckId(t *testing.T) {
+	var err error
+	deckIdResolvers, err = newDeckIdResolvers(DecksConfig{Builtin: map[string]string{"1": "PYX"},
+		Services: []DeckServiceConfig{{Name: "Example", Prefix: "ex-", Length: 6, Offset: 1000000000}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		id        string
+		want      string
+		dbId      int64
+		watermark string
+	}{
+		{"1", "1", 1, "PYX"},
+		{"ID:1", "1", 1, "PYX"},
+		{"7", "7", 7, ""},
+		{"123456", "123456", 123456, ""},
+		{"id:7", "7", 7, ""},
+		{"ABCDE", "ABCDE", -17325410, "ABCDE"},
+		{"12345", "12345", -1776965, "12345"},
+		{"ID:12345", "ID:12345", 12345, ""},
+		{"EX-ABCDEF", "EX-ABCDEF", -1623714775, "ABCDEF"},
+		{"ID:-5", "00005", -5, "00005"},
+		{"ID:0", "ID:0", 0, ""},
+	}
+	for _, test := range tests {
+		deck, err := resolveDeckId(test.id)
+		if err != nil {
+			t.Errorf("resolveDeckId(%q) failed: %v", test.id, err)
+			continue
+		}
+		if deck.Id != test.want || deck.DbId != test.dbId || deck.Watermark != test.watermark {
+			t.Errorf("resolveDeckId(%q) = %+v, want %s (%d) with watermark %q", test.id, deck, test.want,
+				test.dbId, test.watermark)
+		}
+	}
+	for _, id := range []string{"0", "-5", "+7", "07", "ID:x", "x", "ABCDEF"} {
+		if deck, err := resolveDeckId(id); err == nil {
+			t.Errorf("resolveDeckId(%q) = %+v, want an error", id, deck)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/ajanata/pyx-metrics-viewer/api"
+	"github.com/lib/pq"
+)
+
+type errorKind int
+
+const (
+	errInternal errorKind = iota
+	errNotFound
+	errBadId
+	errBadRequest
+	errRemoved
+	errUnauthorized
+	errForbidden
+	errRateLimited
+	errUnavailable
+	errTimeout
+)
+
+// Everything a client needs to describe a kind of error: the HTTP status it maps to, and the RFC
+// 7807 problem type and title.
+type errorKindInfo struct {
+	status      int
+	problemType string
+	title       string
+}
+
+var errorKinds = map[errorKind]errorKindInfo{
+	errInternal:     {500, api.ProblemInternal, "Internal error"},
+	errNotFound:     {404, api.ProblemNotFound, "Not found"},
+	errBadId:        {400, api.ProblemBadId, "Invalid ID"},
+	errBadRequest:   {400, api.ProblemBadRequest, "Bad request"},
+	errRemoved:      {410, api.ProblemRemoved, "Removed"},
+	errUnauthorized: {401, api.ProblemUnauthorized, "Unauthorized"},
+	errForbidden:    {403, api.ProblemForbidden, "Forbidden"},
+	errRateLimited:  {429, api.ProblemRateLimited, "Too many requests"},
+	errUnavailable:  {503, api.ProblemUnavailable, "Database unavailable"},
+	errTimeout:      {504, api.ProblemTimeout, "Database timeout"},
+}
+
+// viewerError is an error that knows what kind of problem it is. detail is shown to the user, while
+// cause (if any) is only logged.
+type viewerError struct {
+	kind   errorKind
+	detail string
+	cause  error
+}
+
+func (e *viewerError) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%s: %v", e.detail, e.cause)
+	}
+	return e.detail
+}
+
+func (e *viewerError) Unwrap() error {
+	return e.cause
+}
+
+func newError(kind errorKind, format string, args ...interface{}) error {
+	return &viewerError{kind: kind, detail: fmt.Sprintf(format, args...)}
+}
+
+func notFoundError(format string, args ...interface{}) error {
+	return newError(errNotFound, format, args...)
+}
+
+func badIdError(format string, args ...interface{}) error {
+	return newError(errBadId, format, args...)
+}
+
+func badRequestError(format string, args ...interface{}) error {
+	return newError(errBadRequest, format, args...)
+}
+
+// dbError wraps an error returned by the database driver, working out whether it was because the
+// database could not be reached, the query took too long, or something else went wrong.
+func dbError(err error, format string, args ...interface{}) error {
+	return &viewerError{
+		kind:   classifyDbError(err),
+		detail: fmt.Sprintf(format, args...),
+		cause:  err,
+	}
+}
+
+func classifyDbError(err error) errorKind {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errTimeout
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code == "57014": // query_canceled, i.e. statement_timeout
+			return errTimeout
+		case pqErr.Code.Class() == "08", // connection_exception
+			pqErr.Code.Class() == "53", // insufficient_resources
+			pqErr.Code.Class() == "57": // operator_intervention, e.g. shutting down
+			return errUnavailable
+		}
+		return errInternal
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return errUnavailable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return errTimeout
+		}
+		return errUnavailable
+	}
+	return errInternal
+}
+
+// kindOf determines the kind of any error, treating anything we didn't create as internal.
+func kindOf(err error) errorKind {
+	var ve *viewerError
+	if errors.As(err, &ve) {
+		return ve.kind
+	}
+	return errInternal
+}
+
+// publicDetail is the part of the error that is safe to show to the user.
+func publicDetail(err error) string {
+	var ve *viewerError
+	if errors.As(err, &ve) {
+		return ve.detail
+	}
+	return "An unexpected error occurred."
+}
+
+// None of the IDs we deal with (round, game, session, and persistent IDs) have anything other than
+// these in them, so we can reject anything else before bothering the database.
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,128}$`)
+
+func validateId(what string, id string) error {
+	if !idPattern.MatchString(id) {
+		return badIdError("'%s' is not a valid %s ID.", id, what)
+	}
+	return nil
+}
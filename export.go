@@ -0,0 +1,393 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+var getUserExistsStmt *sql.Stmt
+var getExportRoundsStmt *sql.Stmt
+var getExportGamesStmt *sql.Stmt
+
+type exportHandler struct{}
+
+// exportFile is one kind of record in a user's data export, which goes in the ZIP as both JSON and
+// CSV. Each of those runs the query again, so that nothing has to be held onto in between.
+type exportFile struct {
+	name   string
+	header []string
+	// each calls emit with every record, in order, and its CSV row.
+	each func(ctx context.Context, persistentId string, emit func(record interface{}, row []string) error) error
+}
+
+var exportFiles = []exportFile{
+	{"sessions", []string{"session", "player", "logged in"}, eachExportSession},
+	{"rounds", []string{"round", "game", "time", "session", "player", "role", "won", "black card", "white cards"},
+		eachExportRound},
+	{"games", []string{"game", "session", "player", "started"}, eachExportGame},
+}
+
+func init() {
+	log.Debug("Registering export handler")
+	registerHandler(exportHandler{})
+}
+
+func (h exportHandler) registerEndpoints(r *gin.Engine) {
+	log.Debug("Registering endpoint for export handler")
+	r.GET("/user/:id/export", getUserExport)
+}
+
+func (h exportHandler) prepareStatements(db *sql.DB) error {
+	log.Debug("Preparing statements for export handler")
+	var err error
+	getUserExistsStmt, err = db.Prepare("SELECT EXISTS(SELECT 1 FROM user_session WHERE persistent_id = $1)")
+	if err != nil {
+		return err
+	}
+
+	// The plays and the picks of a judged round come out a card per row, in order, to be put back
+	// together as they're read. The cards come with their uids and watermarks to be filtered.
+	getExportRoundsStmt, err = db.Prepare("SELECT rc.round_id, rc.game_id, ((rc.meta).timestamp AT TIME ZONE 'UTC') ts, " +
+		"  jt.session_id, 'played' AS role, (rc.winner_session_id = jt.session_id), " +
+		"  bc.uid, bc.text, bc.watermark, wc.uid, wc.text, wc.watermark, jt.white_card_index " +
+		"FROM round_complete__user_session__white_card jt " +
+		"JOIN round_complete rc ON rc.uid = jt.round_complete_uid " +
+		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
+		"JOIN white_card wc ON wc.uid = jt.white_card_uid " +
+		"WHERE jt.session_id IN (SELECT session_id FROM user_session WHERE persistent_id = $1) " +
+		"UNION ALL " +
+		"SELECT rc.round_id, rc.game_id, ((rc.meta).timestamp AT TIME ZONE 'UTC') ts, " +
+		"  rc.judge_session_id, 'judged' AS role, FALSE, " +
+		"  bc.uid, bc.text, bc.watermark, wc.uid, wc.text, wc.watermark, jt.white_card_index " +
+		"FROM round_complete rc " +
+		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
+		"LEFT JOIN round_complete__user_session__white_card jt ON jt.round_complete_uid = rc.uid " +
+		"  AND jt.session_id = rc.winner_session_id " +
+		"LEFT JOIN white_card wc ON wc.uid = jt.white_card_uid " +
+		"WHERE rc.judge_session_id IN (SELECT session_id FROM user_session WHERE persistent_id = $1) " +
+		"ORDER BY ts, round_id, role, white_card_index")
+	if err != nil {
+		return err
+	}
+
+	// Like the session page, this assumes that nobody judges a round in a game they haven't played in.
+	getExportGamesStmt, err = db.Prepare("SELECT s.game_id, s.session_id, ((gs.meta).timestamp AT TIME ZONE 'UTC') " +
+		"FROM (" +
+		"  SELECT DISTINCT rc.game_id, jt.session_id " +
+		"  FROM round_complete__user_session__white_card jt " +
+		"  JOIN round_complete rc ON rc.uid = jt.round_complete_uid " +
+		"  WHERE jt.session_id IN (SELECT session_id FROM user_session WHERE persistent_id = $1) " +
+		"    AND jt.white_card_index = 0" +
+		") s " +
+		"LEFT JOIN game_start gs ON gs.game_id = s.game_id " +
+		"ORDER BY ((gs.meta).timestamp), s.game_id, s.session_id")
+	return err
+}
+
+// getUserExport sends everything there is about a user as a ZIP. It's written out as the queries
+// are read, so the response has already started by the time anything can go wrong with them; if it
+// does, the ZIP ends with an error.txt instead of the rest of the files.
+func getUserExport(c *gin.Context) {
+	id := c.Param("id")
+	if err := validateId("persistent", id); err != nil {
+		returnError(c, err)
+		return
+	}
+	admin, err := authorizeExport(c, id)
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+
+	ctx, cancel := queryContext(c)
+	var exists bool
+	err = getUserExistsStmt.QueryRowContext(ctx, id).Scan(&exists)
+	cancel()
+	if err != nil {
+		returnError(c, dbError(err, "Unable to query for user with id %s.", id))
+		return
+	}
+	if !exists {
+		returnError(c, notFoundError("No sessions were found for that persistent ID."))
+		return
+	}
+	if admin != "" {
+		recordAudit(admin, "export", "user", id, "")
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="pyx-%s.zip"`, id))
+	c.Status(200)
+	z := zip.NewWriter(c.Writer)
+	if err = writeExport(c, z, id); err != nil {
+		log.Errorf("Unable to finish export for user %s: %v", id, err)
+		if w, zerr := z.Create("error.txt"); zerr == nil {
+			fmt.Fprintf(w, "Something went wrong while putting this together, so it isn't complete. "+
+				"Try again later.\n")
+		}
+	}
+	if err = z.Close(); err != nil {
+		log.Errorf("Unable to finish export for user %s: %v", id, err)
+	}
+}
+
+// authorizeExport lets through anyone with a signed link for the user, and moderators. It returns
+// the moderator's name, if it was one.
+func authorizeExport(c *gin.Context, persistentId string) (string, error) {
+	if userLinksSigned() && c.Query("sig") != "" {
+		return "", checkUserLink(c, persistentId)
+	}
+	if len(config.Admin.Users) == 0 {
+		if userLinksSigned() {
+			return "", newError(errForbidden, "Exports can only be downloaded through a link from the game.")
+		}
+		return "", newError(errForbidden, "Exports are turned off, since there's no way to tell who is asking for one.")
+	}
+	user, _, err := authenticateAdmin(c.Request)
+	if err != nil {
+		if kindOf(err) == errUnauthorized {
+			c.Header("WWW-Authenticate", adminAuthChallenge)
+		}
+		return "", err
+	}
+	if session := (model.AdminSession{User: user.Name, Roles: user.Roles}); !session.HasRole("moderator") {
+		return "", newError(errForbidden, "That needs the moderator role.")
+	}
+	return user.Name, nil
+}
+
+// exportLink is where the user page links to for the export, passing along the link it was signed
+// with. It's empty if nobody could download it.
+func exportLink(c *gin.Context, persistentId string) string {
+	path := "user/" + url.PathEscape(persistentId) + "/export"
+	switch {
+	case userLinksSigned() && c.Query("sig") != "":
+		query := url.Values{"sig": {c.Query("sig")}}
+		if expires := c.Query("expires"); expires != "" {
+			query.Set("expires", expires)
+		}
+		return path + "?" + query.Encode()
+	case len(config.Admin.Users) > 0:
+		return path
+	}
+	return ""
+}
+
+func writeExport(c *gin.Context, z *zip.Writer, persistentId string) error {
+	for _, file := range exportFiles {
+		if err := writeExportJSON(c, z, persistentId, file); err != nil {
+			return err
+		}
+		if err := writeExportCSV(c, z, persistentId, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportContext gives each query its own timeout, since a whole export can take a lot longer than
+// any one page. Card text is sanitized HTML, or plain text with text=plain.
+func exportContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	ctx := c.Request.Context()
+	if c.Query("text") == "plain" {
+		ctx = withPlainText(ctx)
+	}
+	return context.WithTimeout(ctx, queryTimeout())
+}
+
+func writeExportJSON(c *gin.Context, z *zip.Writer, persistentId string, file exportFile) error {
+	w, err := z.Create(file.name + ".json")
+	if err != nil {
+		return err
+	}
+	ctx, cancel := exportContext(c)
+	defer cancel()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	sep := "[\n"
+	err = file.each(ctx, persistentId, func(record interface{}, _ []string) error {
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		sep = ","
+		return enc.Encode(record)
+	})
+	if err != nil {
+		return err
+	}
+	if sep == "[\n" {
+		_, err = io.WriteString(w, "[]\n")
+	} else {
+		_, err = io.WriteString(w, "]\n")
+	}
+	return err
+}
+
+func writeExportCSV(c *gin.Context, z *zip.Writer, persistentId string, file exportFile) error {
+	w, err := z.Create(file.name + ".csv")
+	if err != nil {
+		return err
+	}
+	ctx, cancel := exportContext(c)
+	defer cancel()
+
+	out := csv.NewWriter(w)
+	if err = out.Write(file.header); err != nil {
+		return err
+	}
+	err = file.each(ctx, persistentId, func(_ interface{}, row []string) error {
+		return out.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func exportTime(timestamp int64) string {
+	if timestamp == 0 {
+		return ""
+	}
+	return time.Unix(timestamp, 0).UTC().Format(time.RFC1123)
+}
+
+func eachExportSession(ctx context.Context, persistentId string, emit func(interface{}, []string) error) error {
+	q, err := getUserSessionsStmt.QueryContext(ctx, persistentId)
+	if err != nil {
+		return dbError(err, "Unable to query for sessions of user with id %s.", persistentId)
+	}
+	defer q.Close()
+	for q.Next() {
+		var timestamp time.Time
+		session := model.ExportSession{}
+		if err = q.Scan(&session.SessionId, &timestamp); err != nil {
+			return dbError(err, "Unable to read sessions of user with id %s.", persistentId)
+		}
+		session.Player = pseudonym(session.SessionId)
+		session.LogInTimestamp = timestamp.Unix()
+		err = emit(session, []string{session.SessionId, session.Player, exportTime(session.LogInTimestamp)})
+		if err != nil {
+			return err
+		}
+	}
+	if q.Err() != nil {
+		return dbError(q.Err(), "Unable to read sessions of user with id %s.", persistentId)
+	}
+	return nil
+}
+
+func eachExportRound(ctx context.Context, persistentId string, emit func(interface{}, []string) error) error {
+	q, err := getExportRoundsStmt.QueryContext(ctx, persistentId)
+	if err != nil {
+		return dbError(err, "Unable to query for rounds of user with id %s.", persistentId)
+	}
+	defer q.Close()
+
+	var round *model.ExportRound
+	flush := func() error {
+		if round == nil {
+			return nil
+		}
+		return emit(*round, []string{round.RoundId, round.GameId, exportTime(round.Timestamp), round.SessionId,
+			round.Player, round.Role, strconv.FormatBool(round.Won), round.BlackCard,
+			strings.Join(round.WhiteCards, " / ")})
+	}
+	for q.Next() {
+		var roundId, gameId, sessionId, role string
+		var timestamp time.Time
+		var won bool
+		blackCard := model.Card{Meta: model.CardMeta{Color: "black"}}
+		var whiteUid, index sql.NullInt64
+		var whiteText, whiteWatermark sql.NullString
+		err = q.Scan(&roundId, &gameId, &timestamp, &sessionId, &role, &won, &blackCard.UID, &blackCard.Text,
+			&blackCard.Watermark, &whiteUid, &whiteText, &whiteWatermark, &index)
+		if err != nil {
+			return dbError(err, "Unable to read rounds of user with id %s.", persistentId)
+		}
+		if round == nil || round.RoundId != roundId || round.Role != role {
+			if err = flush(); err != nil {
+				return err
+			}
+			filterCard(ctx, &blackCard)
+			round = &model.ExportRound{RoundId: roundId, GameId: gameId, Timestamp: timestamp.Unix(),
+				SessionId: sessionId, Player: pseudonym(sessionId), Role: role, Won: won, BlackCard: blackCard.Text,
+				WhiteCards: []string{}}
+		}
+		if whiteUid.Valid {
+			whiteCard := model.Card{UID: whiteUid.Int64, Text: whiteText.String, Watermark: whiteWatermark.String,
+				Meta: model.CardMeta{Color: "white"}}
+			filterCard(ctx, &whiteCard)
+			round.WhiteCards = append(round.WhiteCards, whiteCard.Text)
+		}
+	}
+	if q.Err() != nil {
+		return dbError(q.Err(), "Unable to read rounds of user with id %s.", persistentId)
+	}
+	return flush()
+}
+
+func eachExportGame(ctx context.Context, persistentId string, emit func(interface{}, []string) error) error {
+	q, err := getExportGamesStmt.QueryContext(ctx, persistentId)
+	if err != nil {
+		return dbError(err, "Unable to query for games of user with id %s.", persistentId)
+	}
+	defer q.Close()
+	for q.Next() {
+		var started pq.NullTime
+		game := model.ExportGame{}
+		if err = q.Scan(&game.GameId, &game.SessionId, &started); err != nil {
+			return dbError(err, "Unable to read games of user with id %s.", persistentId)
+		}
+		game.Player = pseudonym(game.SessionId)
+		if started.Valid {
+			game.StartTimestamp = started.Time.Unix()
+		}
+		err = emit(game, []string{game.GameId, game.SessionId, game.Player,
+			exportTime(game.StartTimestamp)})
+		if err != nil {
+			return err
+		}
+	}
+	if q.Err() != nil {
+		return dbError(q.Err(), "Unable to read games of user with id %s.", persistentId)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+)
+
+// what a card is replaced with when it's filtered in card mode
+const filteredCardText = "(This card has been filtered.)"
+
+// what each matching span is replaced with in redact mode
+const redactedText = "(filtered)"
+
+// urlPattern finds things that are meant to be links: anything with a scheme, anything starting
+// with www., and bare domains on TLDs that people actually type. The TLDs are limited so that
+// things like "Mr.Smith" aren't taken for domains.
+var urlPattern = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://[^\s<>"]+|www\.[^\s<>"]+|` +
+	`(?:[a-z0-9-]+\.)+(?:com|net|org|co|uk|io|info|biz|gov|edu|us|me|tv|ly|gg|xyz|ru|de|ca|au|be|it|nl|to)\b(?:/[^\s<>"]*)?)`)
+
+// urlHostPattern picks the host out of a URL found by urlPattern.
+var urlHostPattern = regexp.MustCompile(`(?i)^(?:[a-z][a-z0-9+.-]*://)?([^/:?#\s]+)`)
+
+// filterRule finds the spans of text it objects to (or, in the allowlist, vouches for).
+type filterRule struct {
+	// source is the rule as it was written in the config, for logging.
+	source string
+	match  func(text string) [][]int
+}
+
+// cardFilter is the compiled form of the filter config.
+type cardFilter struct {
+	rules  []filterRule
+	allow  []filterRule
+	redact bool
+}
+
+// activeFilter is what cards are filtered with. Operators can change it while the viewer is running.
+var activeFilter = struct {
+	sync.RWMutex
+	filter *cardFilter
+	rules  model.FilterRules
+}{}
+
+// currentFilter is the filter in use, and the rules it was made from.
+func currentFilter() (*cardFilter, model.FilterRules) {
+	activeFilter.RLock()
+	defer activeFilter.RUnlock()
+	return activeFilter.filter, activeFilter.rules
+}
+
+// setFilter starts filtering cards with a new set of rules.
+func setFilter(rules model.FilterRules) error {
+	f, err := newCardFilter(rules)
+	if err != nil {
+		return err
+	}
+	activeFilter.Lock()
+	activeFilter.filter = f
+	activeFilter.rules = rules
+	activeFilter.Unlock()
+	purgeTopCache()
+	return nil
+}
+
+// newCardFilter compiles a set of rules.
+func newCardFilter(rules model.FilterRules) (*cardFilter, error) {
+	f := &cardFilter{}
+	switch rules.Mode {
+	case "card":
+	case "redact":
+		f.redact = true
+	default:
+		return nil, fmt.Errorf("unknown filter mode %s", rules.Mode)
+	}
+
+	for _, source := range rules.Rules {
+		rule, err := newFilterRule(source)
+		if err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, rule)
+	}
+	for _, source := range rules.Allow {
+		rule, err := newFilterRule(source)
+		if err != nil {
+			return nil, err
+		}
+		f.allow = append(f.allow, rule)
+	}
+	return f, nil
+}
+
+// newFilterRule compiles one rule, written as type:pattern. The types are substring (ignoring
+// case), regex, and domain (the domain or any subdomain of it, in anything that looks like a URL).
+// "url" on its own is any URL at all.
+func newFilterRule(source string) (filterRule, error) {
+	if source == "url" {
+		return filterRule{source: source, match: func(text string) [][]int {
+			return urlPattern.FindAllStringIndex(text, -1)
+		}}, nil
+	}
+
+	i := strings.Index(source, ":")
+	if i < 0 {
+		return filterRule{}, fmt.Errorf("filter rule %s has no type", source)
+	}
+	kind, pattern := source[:i], source[i+1:]
+	if pattern == "" {
+		return filterRule{}, fmt.Errorf("filter rule %s is empty", source)
+	}
+	switch kind {
+	case "substring":
+		re := regexp.MustCompile("(?i)" + regexp.QuoteMeta(pattern))
+		return filterRule{source: source, match: func(text string) [][]int {
+			return re.FindAllStringIndex(text, -1)
+		}}, nil
+	case "regex":
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return filterRule{}, fmt.Errorf("filter rule %s: %v", source, err)
+		}
+		return filterRule{source: source, match: func(text string) [][]int {
+			return re.FindAllStringIndex(text, -1)
+		}}, nil
+	case "domain":
+		domain := strings.ToLower(strings.TrimPrefix(pattern, "."))
+		return filterRule{source: source, match: func(text string) [][]int {
+			var spans [][]int
+			for _, span := range urlPattern.FindAllStringIndex(text, -1) {
+				host := urlHostPattern.FindStringSubmatch(text[span[0]:span[1]])
+				if host == nil {
+					continue
+				}
+				h := strings.ToLower(host[1])
+				if h == domain || strings.HasSuffix(h, "."+domain) {
+					spans = append(spans, span)
+				}
+			}
+			return spans
+		}}, nil
+	}
+	return filterRule{}, fmt.Errorf("filter rule %s has unknown type %s", source, kind)
+}
+
+// filterMatch is a span of a card's text that a rule objected to.
+type filterMatch struct {
+	rule  string
+	start int
+	end   int
+}
+
+// matches finds every span of text that a rule objects to and the allowlist doesn't cover, in
+// order.
+func (f *cardFilter) matches(text string) []filterMatch {
+	var allowed [][]int
+	for _, rule := range f.allow {
+		allowed = append(allowed, rule.match(text)...)
+	}
+
+	var found []filterMatch
+	for _, rule := range f.rules {
+	spans:
+		for _, span := range rule.match(text) {
+			for _, allow := range allowed {
+				if allow[0] <= span[0] && span[1] <= allow[1] {
+					continue spans
+				}
+			}
+			found = append(found, filterMatch{rule: rule.source, start: span[0], end: span[1]})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].start < found[j].start
+	})
+	return found
+}
+
+// matchedRules are the rules that matched, each once.
+func matchedRules(found []filterMatch) []string {
+	rules := []string{}
+	for _, match := range found {
+		if !containsString(rules, match.rule) {
+			rules = append(rules, match.rule)
+		}
+	}
+	return rules
+}
+
+// apply returns what's left of the text once it's been filtered, and what it was filtered for.
+func (f *cardFilter) apply(text string) (string, []filterMatch) {
+	found := f.matches(text)
+	if len(found) == 0 {
+		return text, nil
+	}
+	if !f.redact {
+		return filteredCardText, found
+	}
+
+	// replace each run of overlapping spans once
+	var b strings.Builder
+	pos := 0
+	for _, match := range found {
+		if match.end <= pos {
+			continue
+		}
+		if match.start >= pos {
+			b.WriteString(text[pos:match.start])
+			b.WriteString(redactedText)
+		}
+		pos = match.end
+	}
+	b.WriteString(text[pos:])
+	// the spans can start or end inside markup
+	return sanitizeHtml(b.String()), found
+}
+
+// filterCard sanitizes and filters the text of a card, black or white, that's about to be shown to
+// someone.
+func filterCard(ctx context.Context, card *model.Card) {
+	if cardBlocked(card) {
+		card.Text = blockedCardText
+		return
+	}
+	card.Text = sanitizeHtml(card.Text)
+	if filter, _ := currentFilter(); filter != nil {
+		text, found := filter.apply(card.Text)
+		if len(found) > 0 {
+			log.Debugf("Filtering %s card %d for matching '%s': '%s'", card.Meta.Color, card.UID, found[0].rule,
+				card.Text)
+			recordFilterHit(card, matchedRules(found))
+			card.Text = text
+		}
+	}
+	if wantsPlainText(ctx) {
+		card.Text = plainText(card.Text)
+	}
+}
+
+// filterCards filters every card in a list.
+func filterCards(ctx context.Context, cards []model.Card) {
+	for i := range cards {
+		filterCard(ctx, &cards[i])
+	}
+}
+
+// filterRoundCards filters the black card of every round in a list.
+func filterRoundCards(ctx context.Context, rounds []model.RoundMeta) {
+	for i := range rounds {
+		filterCard(ctx, &rounds[i].BlackCard)
+	}
+}
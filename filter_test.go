@@ -0,0 +1,96 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+)
+
+func TestNewFilterRuleErrors(t *testing.T) {
+	for _, source := range []string{"nocolon", "substring:", "regex:(", "glob:*.com"} {
+		if _, err := newFilterRule(source); err == nil {
+			t.Errorf("newFilterRule(%q) should have failed", source)
+		}
+	}
+	if _, err := newCardFilter(model.FilterRules{Mode: "shout"}); err == nil {
+		t.Error("newCardFilter with an unknown mode should have failed")
+	}
+}
+
+func TestCardFilter(t *testing.T) {
+	rules := []string{"substring:[img]", "regex:(?i)\\bbadword\\b", "domain:evil.net"}
+	allow := []string{"domain:pretendyoure.xyz"}
+	tests := []struct {
+		name    string
+		rules   []string
+		text    string
+		card    string
+		redact  string
+		matched []string
+	}{
+		{"clean", rules, "Coca-Cola.", "Coca-Cola.", "Coca-Cola.", nil},
+		{"substring ignores case", rules, "an [IMG] tag", filteredCardText, "an (filtered) tag", []string{"substring:[img]"}},
+		{"regex", rules, "a BadWord here", filteredCardText, "a (filtered) here", []string{"regex:(?i)\\bbadword\\b"}},
+		{"regex word boundary", rules, "badwords", "badwords", "badwords", nil},
+		{"domain", rules, "see evil.net now", filteredCardText, "see (filtered) now", []string{"domain:evil.net"}},
+		{"subdomain", rules, "http://www.evil.net/x", filteredCardText, "(filtered)", []string{"domain:evil.net"}},
+		{"other domain", rules, "noevil.net", "noevil.net", "noevil.net", nil},
+		{"two rules", rules, "[img] badword", filteredCardText, "(filtered) (filtered)",
+			[]string{"substring:[img]", "regex:(?i)\\bbadword\\b"}},
+		{"any url", []string{"url"}, "go to www.example.org", filteredCardText, "go to (filtered)", []string{"url"}},
+		{"not a url", []string{"url"}, "Mr.Smith goes home.", "Mr.Smith goes home.", "Mr.Smith goes home.", nil},
+		{"allowlisted", []string{"url"}, "see pretendyoure.xyz", "see pretendyoure.xyz", "see pretendyoure.xyz", nil},
+		{"overlapping", []string{"substring:abc", "substring:bcd"}, "xabcdx", filteredCardText, "x(filtered)x",
+			[]string{"substring:abc", "substring:bcd"}},
+		{"redacting markup", []string{"regex:b>x"}, "<b>x</b>", filteredCardText, "&lt;(filtered)",
+			[]string{"regex:b>x"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, mode := range []string{"card", "redact"} {
+				f, err := newCardFilter(model.FilterRules{Rules: test.rules, Allow: allow, Mode: mode})
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := test.card
+				if mode == "redact" {
+					want = test.redact
+				}
+				text, found := f.apply(test.text)
+				if text != want {
+					t.Errorf("%s: apply(%q) = %q, want %q", mode, test.text, text, want)
+				}
+				var matched []string
+				if len(found) > 0 {
+					matched = matchedRules(found)
+				}
+				if !reflect.DeepEqual(matched, test.matched) {
+					t.Errorf("%s: apply(%q) matched %v, want %v", mode, test.text, matched, test.matched)
+				}
+			}
+		})
+	}
+}
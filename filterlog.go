@@ -0,0 +1,304 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"github.com/gin-gonic/gin"
+)
+
+// where filter hits are saved in the data directory, and how often
+const (
+	filterHitsFile         = "filterhits.json"
+	filterHitsSaveInterval = time.Minute
+)
+
+// how many cards to list on the dashboard, and in each list when testing rules
+const (
+	filterDashboardCards = 50
+	filterTestCards      = 100
+)
+
+var getAllCardTextStmt *sql.Stmt
+
+type filterHandler struct{}
+
+// filterHitLog is what has been filtered since Since, and is what gets saved between runs.
+type filterHitLog struct {
+	Since time.Time
+	// Cards are by color and uid.
+	Cards map[string]*model.FilteredCard
+	Rules map[string]int64
+}
+
+var filterHits = struct {
+	sync.Mutex
+	log filterHitLog
+	// dirty is whether there's anything that hasn't been saved yet
+	dirty bool
+}{
+	log: newFilterHitLog(),
+}
+
+func init() {
+	log.Debug("Registering filter handler")
+	registerHandler(filterHandler{})
+}
+
+func newFilterHitLog() filterHitLog {
+	return filterHitLog{
+		Since: time.Now(),
+		Cards: map[string]*model.FilteredCard{},
+		Rules: map[string]int64{},
+	}
+}
+
+// configFilterRules are the rules in the config. The old FilteredText list is still honored, as
+// substring rules.
+func configFilterRules() model.FilterRules {
+	rules := model.FilterRules{Rules: []string{}, Allow: config.Filter.Allow, Mode: config.Filter.Mode}
+	for _, text := range config.FilteredText {
+		rules.Rules = append(rules.Rules, "substring:"+text)
+	}
+	rules.Rules = append(rules.Rules, config.Filter.Rules...)
+	return rules
+}
+
+func (filterHandler) prepareStatements(db *sql.DB) error {
+	log.Debug("Preparing statements for filter handler")
+	err := setFilter(configFilterRules())
+	if err != nil {
+		return err
+	}
+
+	saved := newFilterHitLog()
+	if err = readJSONFile(filterHitsFile, &saved); err != nil {
+		return err
+	}
+	if saved.Cards == nil {
+		saved.Cards = map[string]*model.FilteredCard{}
+	}
+	if saved.Rules == nil {
+		saved.Rules = map[string]int64{}
+	}
+	filterHits.Lock()
+	filterHits.log = saved
+	filterHits.Unlock()
+
+	getAllCardTextStmt, err = db.Prepare("SELECT 'black', uid, text, watermark FROM black_card " +
+		"UNION ALL " +
+		"SELECT 'white', uid, text, watermark FROM white_card")
+	return err
+}
+
+func (filterHandler) registerEndpoints(*gin.Engine) {
+	// the dashboard is only for moderators
+}
+
+func (filterHandler) registerAdminEndpoints(r *gin.RouterGroup) {
+	log.Debug("Registering admin endpoints for filter handler")
+	r.GET("/filter", requireRole("moderator"), getFilterDashboard)
+	r.POST("/filter", requireRole("moderator"), testFilterRules)
+}
+
+func (filterHandler) runInBackground() {
+	for {
+		time.Sleep(filterHitsSaveInterval)
+		saveFilterHits()
+	}
+}
+
+// recordFilterHit notes that a card was filtered for matching rules. The card has its text from
+// before it was filtered.
+func recordFilterHit(card *model.Card, rules []string) {
+	key := blockKey(card.Meta.Color, strconv.FormatInt(card.UID, 10))
+	filterHits.Lock()
+	defer filterHits.Unlock()
+	hit, ok := filterHits.log.Cards[key]
+	if !ok {
+		hit = &model.FilteredCard{Card: *card}
+		filterHits.log.Cards[key] = hit
+	}
+	hit.Card.Text = card.Text
+	hit.Hits++
+	hit.LastHit = time.Now()
+	for _, rule := range rules {
+		if !containsString(hit.Rules, rule) {
+			hit.Rules = append(hit.Rules, rule)
+		}
+		filterHits.log.Rules[rule]++
+	}
+	filterHits.dirty = true
+}
+
+func saveFilterHits() {
+	filterHits.Lock()
+	defer filterHits.Unlock()
+	if !filterHits.dirty {
+		return
+	}
+	if err := writeJSONFile(filterHitsFile, filterHits.log); err != nil {
+		log.Errorf("Unable to save filter hits: %v", err)
+		return
+	}
+	filterHits.dirty = false
+}
+
+func getFilterDashboard(c *gin.Context) {
+	dashboard := loadFilterDashboard()
+	dashboard.Admin = adminSession(c)
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(http.StatusOK, "filter", &dashboard)
+	} else {
+		c.JSON(http.StatusOK, dashboard)
+	}
+}
+
+// loadFilterDashboard gathers up the most filtered cards and the rules that filtered them.
+func loadFilterDashboard() model.FilterDashboard {
+	_, current := currentFilter()
+	filterHits.Lock()
+	dashboard := model.FilterDashboard{
+		Since:   filterHits.log.Since,
+		Cards:   make([]model.FilteredCard, 0, len(filterHits.log.Cards)),
+		Rules:   make([]model.FilterRuleHits, 0, len(filterHits.log.Rules)),
+		Current: current,
+	}
+	for _, hit := range filterHits.log.Cards {
+		copied := *hit
+		copied.Rules = append([]string{}, hit.Rules...)
+		dashboard.Cards = append(dashboard.Cards, copied)
+	}
+	for rule, hits := range filterHits.log.Rules {
+		dashboard.Rules = append(dashboard.Rules, model.FilterRuleHits{Rule: rule, Hits: hits})
+	}
+	filterHits.Unlock()
+
+	sort.Slice(dashboard.Cards, func(i, j int) bool {
+		return dashboard.Cards[i].Hits > dashboard.Cards[j].Hits
+	})
+	if len(dashboard.Cards) > filterDashboardCards {
+		dashboard.Cards = dashboard.Cards[:filterDashboardCards]
+	}
+	sort.Slice(dashboard.Rules, func(i, j int) bool {
+		return dashboard.Rules[i].Hits > dashboard.Rules[j].Hits
+	})
+	return dashboard
+}
+
+func testFilterRules(c *gin.Context) {
+	proposed := model.FilterRules{
+		Rules: formLines(c.PostForm("rules")),
+		Allow: formLines(c.PostForm("allow")),
+		Mode:  c.PostForm("mode"),
+	}
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	test, err := loadFilterTest(ctx, proposed)
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+
+	dashboard := loadFilterDashboard()
+	dashboard.Admin = adminSession(c)
+	dashboard.Test = &test
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(http.StatusOK, "filter", &dashboard)
+	} else {
+		c.JSON(http.StatusOK, dashboard)
+	}
+}
+
+// formLines splits a textarea into its lines, leaving out blank ones.
+func formLines(text string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// loadFilterTest checks every card in the black_card and white_card tables against the current rules
+// and the proposed ones, to find the cards they disagree on.
+func loadFilterTest(ctx context.Context, proposed model.FilterRules) (model.FilterTest, error) {
+	proposedFilter, err := newCardFilter(proposed)
+	if err != nil {
+		return model.FilterTest{}, badRequestError("Those rules can't be used: %v.", err)
+	}
+	current, _ := currentFilter()
+	if current == nil {
+		current = &cardFilter{}
+	}
+
+	q, err := getAllCardTextStmt.QueryContext(ctx)
+	if err != nil {
+		return model.FilterTest{}, dbError(err, "Unable to query for card text.")
+	}
+	defer q.Close()
+	test := model.FilterTest{
+		Proposed:        proposed,
+		NewlyFiltered:   []model.FilterTestCard{},
+		NewlyUnfiltered: []model.FilterTestCard{},
+	}
+	for q.Next() {
+		card := model.Card{}
+		err = q.Scan(&card.Meta.Color, &card.UID, &card.Text, &card.Watermark)
+		if err != nil {
+			return model.FilterTest{}, dbError(err, "Unable to read card text.")
+		}
+		test.Checked++
+		card.Text = sanitizeHtml(card.Text)
+		was := current.matches(card.Text)
+		result, would := proposedFilter.apply(card.Text)
+		if len(was) == 0 && len(would) > 0 {
+			test.NewlyFilteredCount++
+			if len(test.NewlyFiltered) < filterTestCards {
+				test.NewlyFiltered = append(test.NewlyFiltered,
+					model.FilterTestCard{Card: card, Rules: matchedRules(would), Result: result})
+			}
+		} else if len(was) > 0 && len(would) == 0 {
+			test.NewlyUnfilteredCount++
+			if len(test.NewlyUnfiltered) < filterTestCards {
+				test.NewlyUnfiltered = append(test.NewlyUnfiltered,
+					model.FilterTestCard{Card: card, Rules: matchedRules(was), Result: result})
+			}
+		}
+	}
+	if q.Err() != nil {
+		return model.FilterTest{}, dbError(q.Err(), "Unable to read card text.")
+	}
+	return test, nil
+}
@@ -24,38 +24,19 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"github.com/ajanata/pyx-metrics-viewer/model"
 	"github.com/gin-gonic/gin"
 	"strings"
 	"time"
 )
 
 var getGameRoundsStmt *sql.Stmt
-
-type RoundMeta struct {
-	RoundId   string
-	Timestamp int64
-	BlackCard Card
-}
-
-type GameMeta struct {
-	GameId    string
-	Timestamp int64
-}
+var getGameScoresStmt *sql.Stmt
 
 type gameHandler struct{}
 
-func (round *RoundMeta) FormattedTimestamp() string {
-	//	return time.Unix(round.Timestamp, 0).UTC().Format("Mon, 02 Jan 2006 15:04:05") + " PDT -0700"
-	return time.Unix(round.Timestamp, 0).UTC().Format(time.RFC1123)
-}
-
-func (game *GameMeta) FormattedTimestamp() string {
-	//	return time.Unix(game.Timestamp, 0).UTC().Format("Mon, 02 Jan 2006 15:04:05") + " PDT -0700"
-	return time.Unix(game.Timestamp, 0).UTC().Format(time.RFC1123)
-}
-
 func init() {
 	log.Debug("Registering game handler")
 	registerHandler(gameHandler{})
@@ -69,35 +50,80 @@ func (h gameHandler) registerEndpoints(r *gin.Engine) {
 func (h gameHandler) prepareStatements(db *sql.DB) error {
 	log.Debug("Preparing statements for game handler")
 	var err error
-	getGameRoundsStmt, err = db.Prepare("SELECT bc.text, bc.watermark, bc.pick, bc.draw, rc.round_id, ((rc.meta).timestamp AT TIME ZONE 'UTC') " +
+	getGameRoundsStmt, err = db.Prepare("SELECT bc.uid, bc.text, bc.watermark, bc.pick, bc.draw, rc.round_id, ((rc.meta).timestamp AT TIME ZONE 'UTC') " +
 		"FROM round_complete rc " +
 		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
 		"WHERE rc.game_id = $1 " +
 		"ORDER BY ((rc.meta).timestamp) DESC")
+	if err != nil {
+		return err
+	}
+	getGameScoresStmt, err = db.Prepare("SELECT s.session_id, SUM(s.played)::int, SUM(s.won)::int, SUM(s.judged)::int " +
+		"FROM (" +
+		"  SELECT jt.session_id, COUNT(*) played, " +
+		"    SUM(CASE WHEN jt.session_id = rc.winner_session_id THEN 1 ELSE 0 END) won, 0 judged " +
+		"  FROM round_complete rc " +
+		"  JOIN round_complete__user_session__white_card jt ON jt.round_complete_uid = rc.uid " +
+		"    AND jt.white_card_index = 0 " +
+		"  WHERE rc.game_id = $1 " +
+		"  GROUP BY jt.session_id " +
+		"  UNION ALL " +
+		"  SELECT rc.judge_session_id, 0, 0, COUNT(*) " +
+		"  FROM round_complete rc " +
+		"  WHERE rc.game_id = $1 " +
+		"  GROUP BY rc.judge_session_id" +
+		") s " +
+		"GROUP BY s.session_id " +
+		"ORDER BY 3 DESC, 2 DESC, 4 DESC, s.session_id")
 	return err
 }
 
 func getGame(c *gin.Context) {
-	q, err := getGameRoundsStmt.Query(c.Param("id"))
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	game, err := loadGame(ctx, c.Param("id"))
 	if err != nil {
-		returnError(c, 500, fmt.Sprintf("Unable to query for game id %s: %v", c.Param("id"), err))
+		returnError(c, err)
 		return
 	}
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(200, "game", &game)
+	} else {
+		c.JSON(200, game.Rounds)
+	}
+}
+
+func loadGame(ctx context.Context, id string) (model.Game, error) {
+	if err := validateId("game", id); err != nil {
+		return model.Game{}, err
+	}
+	if err := checkBlocked("game", id); err != nil {
+		return model.Game{}, err
+	}
+	q, err := getGameRoundsStmt.QueryContext(ctx, id)
+	if err != nil {
+		return model.Game{}, dbError(err, "Unable to query for game id %s.", id)
+	}
 	defer q.Close()
-	rounds := []RoundMeta{}
+	rounds := []model.RoundMeta{}
 	for q.Next() {
+		var uid int64
 		var text string
 		var watermark string
 		var pick int16
 		var draw int16
 		var roundId string
 		var timestamp time.Time
-		q.Scan(&text, &watermark, &pick, &draw, &roundId, &timestamp)
-		rounds = append(rounds, RoundMeta{
-			BlackCard: Card{
+		q.Scan(&uid, &text, &watermark, &pick, &draw, &roundId, &timestamp)
+		if isBlocked("round", roundId) {
+			continue
+		}
+		rounds = append(rounds, model.RoundMeta{
+			BlackCard: model.Card{
+				UID:       uid,
 				Text:      text,
 				Watermark: watermark,
-				Meta: CardMeta{
+				Meta: model.CardMeta{
 					Color: "black",
 					Draw:  draw,
 					Pick:  pick,
@@ -106,13 +132,42 @@ func getGame(c *gin.Context) {
 			RoundId:   roundId,
 			Timestamp: timestamp.Unix(),
 		})
+		filterCard(ctx, &rounds[len(rounds)-1].BlackCard)
 	}
 	if q.Err() != nil {
-		log.Errorf("Error while iterating over rounds for game %s: %+v", c.Param("id"), q.Err())
+		return model.Game{}, dbError(q.Err(), "Unable to read rounds for game id %s.", id)
 	}
-	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
-		c.HTML(200, "game", &rounds)
-	} else {
-		c.JSON(200, rounds)
+	if len(rounds) == 0 {
+		return model.Game{}, notFoundError("That game cannot be found, or no rounds have been completed in it yet.")
+	}
+	q.Close()
+
+	scores, err := loadGameScores(ctx, id)
+	if err != nil {
+		return model.Game{}, err
+	}
+	return model.Game{GameId: id, Rounds: rounds, Scoreboard: scores}, nil
+}
+
+// loadGameScores counts the rounds each player played, won and judged in a game.
+func loadGameScores(ctx context.Context, id string) ([]model.Score, error) {
+	q, err := getGameScoresStmt.QueryContext(ctx, id)
+	if err != nil {
+		return nil, dbError(err, "Unable to query for scores in game id %s.", id)
+	}
+	defer q.Close()
+	scores := []model.Score{}
+	for q.Next() {
+		var sessionId string
+		score := model.Score{}
+		if err = q.Scan(&sessionId, &score.Played, &score.Won, &score.Judged); err != nil {
+			return nil, dbError(err, "Unable to read scores in game id %s.", id)
+		}
+		score.Player = playerName(sessionId)
+		scores = append(scores, score)
+	}
+	if q.Err() != nil {
+		return nil, dbError(q.Err(), "Unable to read scores in game id %s.", id)
 	}
+	return scores, nil
 }
@@ -7,7 +7,9 @@ require (
 	github.com/fatih/camelcase v1.0.0 // indirect
 	github.com/fatih/structs v1.1.0 // indirect
 	github.com/gin-gonic/gin v1.6.3
+	github.com/graphql-go/graphql v0.8.1
 	github.com/koding/multiconfig v0.0.0-20171124222453-69c27309b2d7
 	github.com/lib/pq v1.5.2
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
@@ -0,0 +1,515 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+)
+
+type graphqlHandler struct{}
+
+type loadersKey struct{}
+
+var graphqlSchema graphql.Schema
+
+func init() {
+	log.Debug("Registering GraphQL handler")
+	registerHandler(graphqlHandler{})
+
+	var err error
+	graphqlSchema, err = buildGraphqlSchema()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (h graphqlHandler) registerEndpoints(r *gin.Engine) {
+	log.Debug("Registering endpoints for GraphQL handler")
+	r.GET("/graphql", queryGraphql)
+	r.POST("/graphql", queryGraphql)
+}
+
+func (h graphqlHandler) prepareStatements(db *sql.DB) error {
+	log.Debug("Preparing statements for GraphQL handler")
+	return prepareLoaderStatements(db)
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query" form:"query"`
+	OperationName string                 `json:"operationName" form:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+func queryGraphql(c *gin.Context) {
+	var req graphqlRequest
+	if c.Request.Method == http.MethodGet {
+		req.Query = c.Query("query")
+		req.OperationName = c.Query("operationName")
+		if vars := c.Query("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				returnGraphqlError(c, http.StatusBadRequest, "variables must be a JSON object")
+				return
+			}
+		}
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		returnGraphqlError(c, http.StatusBadRequest, "request body must be a JSON object with a query")
+		return
+	}
+
+	if err := checkQueryCost(graphqlSchema, req.Query, req.OperationName); err != nil {
+		returnGraphqlError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	result := graphql.Do(graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        context.WithValue(ctx, loadersKey{}, newLoaders()),
+	})
+	for _, err := range result.Errors {
+		log.Infof("GraphQL error for request (%s): %v", c.Request.URL, err)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func returnGraphqlError(c *gin.Context, status int, msg string) {
+	log.Infof("Returning GraphQL error (%d) for request (%s): %s", status, c.Request.URL, msg)
+	c.JSON(status, gin.H{"errors": []gin.H{{"message": msg}}})
+}
+
+func loadersFrom(p graphql.ResolveParams) *loaders {
+	return p.Context.Value(loadersKey{}).(*loaders)
+}
+
+// graphqlError makes sure only the public part of our errors ends up in the response.
+func graphqlError(err error) error {
+	if err == nil {
+		return nil
+	}
+	log.Infof("GraphQL resolver error: %v", err)
+	return &publicError{publicDetail(err)}
+}
+
+type publicError struct {
+	msg string
+}
+
+func (e *publicError) Error() string {
+	return e.msg
+}
+
+// load is a resolver for something from a loader, keyed by something about the source.
+func load(which func(*loaders) *loader, key func(source interface{}) string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		thunk := which(loadersFrom(p)).load(p.Context, key(p.Source))
+		return func() (interface{}, error) {
+			v, err := thunk()
+			return v, graphqlError(err)
+		}, nil
+	}
+}
+
+// loadArg is a resolver for something from a loader, keyed by a required id argument.
+func loadArg(which func(*loaders) *loader, arg string, what string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		id := p.Args[arg].(string)
+		if err := validateId(what, id); err != nil {
+			return nil, graphqlError(err)
+		}
+		thunk := which(loadersFrom(p)).load(p.Context, id)
+		return func() (interface{}, error) {
+			v, err := thunk()
+			return v, graphqlError(err)
+		}, nil
+	}
+}
+
+func buildGraphqlSchema() (graphql.Schema, error) {
+	var roundType, playType, cardType, gameType, sessionType, userType, deckType *graphql.Object
+
+	cardType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Card",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"uid": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.ID),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(model.Card).UID, nil
+					},
+				},
+				"text": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(model.Card).Text, nil
+					},
+				},
+				"watermark": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(model.Card).Watermark, nil
+					},
+				},
+				"color": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(model.Card).Meta.Color, nil
+					},
+				},
+				"pick": &graphql.Field{
+					Type: graphql.Int,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(model.Card).Meta.Pick, nil
+					},
+				},
+				"draw": &graphql.Field{
+					Type: graphql.Int,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(model.Card).Meta.Draw, nil
+					},
+				},
+				"deckName": &graphql.Field{
+					Type:        graphql.String,
+					Description: "The name of the deck the card's watermark belongs to.",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return resolveWatermark(p.Source.(model.Card).Watermark).Name, nil
+					},
+				},
+				"deck": &graphql.Field{
+					Type:        deckType,
+					Description: "The deck the card came from, if its watermark belongs to one.",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						deck, ok := deckForWatermark(p.Source.(model.Card).Watermark)
+						if !ok {
+							return nil, nil
+						}
+						return load(func(l *loaders) *loader { return l.deck },
+							func(interface{}) string { return deck.Id })(p)
+					},
+				},
+			}
+		}),
+	})
+
+	playType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Play",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"session": &graphql.Field{
+					Type: sessionType,
+					Resolve: load(func(l *loaders) *loader { return l.session },
+						func(source interface{}) string { return visibleSessionId(source.(model.Play).SessionId) }),
+				},
+				"player": &graphql.Field{
+					Type:        graphql.String,
+					Description: "Pseudonym of the session which made the play.",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return playerName(p.Source.(model.Play).SessionId), nil
+					},
+				},
+				"winner": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.Boolean),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(model.Play).Winner, nil
+					},
+				},
+				"cards": &graphql.Field{
+					Type: graphql.NewList(cardType),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(model.Play).Cards, nil
+					},
+				},
+			}
+		}),
+	})
+
+	roundType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Round",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.ID),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*gqlRound).id, nil
+					},
+				},
+				"timestamp": &graphql.Field{
+					Type: graphql.DateTime,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*gqlRound).timestamp, nil
+					},
+				},
+				"blackCard": &graphql.Field{
+					Type: cardType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*gqlRound).blackCard, nil
+					},
+				},
+				"game": &graphql.Field{
+					Type: gameType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return &gqlGame{id: p.Source.(*gqlRound).gameId}, nil
+					},
+				},
+				"judge": &graphql.Field{
+					Type: sessionType,
+					Resolve: load(func(l *loaders) *loader { return l.session },
+						func(source interface{}) string { return visibleSessionId(source.(*gqlRound).judgeSessionId) }),
+				},
+				"judgeName": &graphql.Field{
+					Type:        graphql.String,
+					Description: "Pseudonym of the session which judged the round.",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return playerName(p.Source.(*gqlRound).judgeSessionId), nil
+					},
+				},
+				"plays": &graphql.Field{
+					Type: graphql.NewList(playType),
+					Resolve: load(func(l *loaders) *loader { return l.playsByRound },
+						func(source interface{}) string { return source.(*gqlRound).id }),
+				},
+			}
+		}),
+	})
+
+	gameType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Game",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.ID),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*gqlGame).id, nil
+					},
+				},
+				"startTimestamp": &graphql.Field{
+					Type: graphql.DateTime,
+					Resolve: load(func(l *loaders) *loader { return l.gameStart },
+						func(source interface{}) string { return source.(*gqlGame).id }),
+				},
+				"rounds": &graphql.Field{
+					Type:        graphql.NewList(roundType),
+					Description: "Completed rounds, most recent first.",
+					Resolve: load(func(l *loaders) *loader { return l.roundsByGame },
+						func(source interface{}) string { return source.(*gqlGame).id }),
+				},
+			}
+		}),
+	})
+
+	sessionType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Session",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.ID),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*gqlSession).id, nil
+					},
+				},
+				"serverId": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						basics := model.SessionBasics{SessionId: p.Source.(*gqlSession).id}
+						return basics.ServerId(), nil
+					},
+				},
+				"logInTimestamp": &graphql.Field{
+					Type: graphql.DateTime,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*gqlSession).logIn, nil
+					},
+				},
+				"user": &graphql.Field{
+					Type: userType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						// nothing leads from a session to its user's page if that needs a signed link
+						if userLinksSigned() {
+							return nil, nil
+						}
+						return &gqlUser{persistentId: p.Source.(*gqlSession).persistentId}, nil
+					},
+				},
+				"games": &graphql.Field{
+					Type: graphql.NewList(gameType),
+					Resolve: load(func(l *loaders) *loader { return l.gamesBySession },
+						func(source interface{}) string { return source.(*gqlSession).id }),
+				},
+				"playedRounds": &graphql.Field{
+					Type:        graphql.NewList(roundType),
+					Description: "Rounds played in, most recent first.",
+					Resolve: load(func(l *loaders) *loader { return l.playedRoundsBySession },
+						func(source interface{}) string { return source.(*gqlSession).id }),
+				},
+				"judgedRounds": &graphql.Field{
+					Type:        graphql.NewList(roundType),
+					Description: "Rounds judged, most recent first.",
+					Resolve: load(func(l *loaders) *loader { return l.judgedRoundsBySession },
+						func(source interface{}) string { return source.(*gqlSession).id }),
+				},
+			}
+		}),
+	})
+
+	userType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"persistentId": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.ID),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*gqlUser).persistentId, nil
+					},
+				},
+				"sessions": &graphql.Field{
+					Type:        graphql.NewList(sessionType),
+					Description: "Sessions, most recent first.",
+					Resolve: load(func(l *loaders) *loader { return l.sessionsByUser },
+						func(source interface{}) string { return source.(*gqlUser).persistentId }),
+				},
+			}
+		}),
+	})
+
+	deckType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Deck",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.ID),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*model.Deck).ID, nil
+					},
+				},
+				"name": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*model.Deck).Name, nil
+					},
+				},
+				"whiteCount": &graphql.Field{
+					Type: graphql.Int,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*model.Deck).WhiteCount, nil
+					},
+				},
+				"blackCount": &graphql.Field{
+					Type: graphql.Int,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*model.Deck).BlackCount, nil
+					},
+				},
+				"whiteCards": &graphql.Field{
+					Type: graphql.NewList(cardType),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*model.Deck).WhiteCards, nil
+					},
+				},
+				"blackCards": &graphql.Field{
+					Type: graphql.NewList(cardType),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*model.Deck).BlackCards, nil
+					},
+				},
+			}
+		}),
+	})
+
+	idArg := graphql.FieldConfigArgument{
+		"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+	}
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"round": &graphql.Field{
+				Type:    roundType,
+				Args:    idArg,
+				Resolve: loadArg(func(l *loaders) *loader { return l.round }, "id", "round"),
+			},
+			"game": &graphql.Field{
+				Type: gameType,
+				Args: idArg,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(string)
+					if err := validateId("game", id); err != nil {
+						return nil, graphqlError(err)
+					}
+					if err := checkBlocked("game", id); err != nil {
+						return nil, graphqlError(err)
+					}
+					return &gqlGame{id: id}, nil
+				},
+			},
+			"session": &graphql.Field{
+				Type:    sessionType,
+				Args:    idArg,
+				Resolve: loadArg(func(l *loaders) *loader { return l.session }, "id", "session"),
+			},
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"persistentId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["persistentId"].(string)
+					if err := validateId("persistent", id); err != nil {
+						return nil, graphqlError(err)
+					}
+					if userLinksSigned() {
+						return nil, graphqlError(newError(errForbidden, "Users can only be seen through a link from the game."))
+					}
+					return &gqlUser{persistentId: id}, nil
+				},
+			},
+			"deck": &graphql.Field{
+				Type: deckType,
+				Args: idArg,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					deck, err := resolveDeckId(strings.ToUpper(p.Args["id"].(string)))
+					if err == nil {
+						err = checkBlocked("deck", deck.Id)
+					}
+					if err != nil {
+						return nil, graphqlError(err)
+					}
+					return load(func(l *loaders) *loader { return l.deck },
+						func(interface{}) string { return deck.Id })(p)
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+}
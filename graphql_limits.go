@@ -0,0 +1,158 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// checkQueryCost rejects queries which are nested too deeply or would load too much, before they
+// get anywhere near the database.
+//
+// Complexity is the number of fields the query could resolve, assuming every list has
+// config.GraphQL.ListCost items in it.
+func checkQueryCost(schema graphql.Schema, query string, operationName string) error {
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(query), Name: "GraphQL request"}),
+	})
+	if err != nil {
+		// let graphql-go report it properly
+		return nil
+	}
+
+	fragments := map[string]*ast.FragmentDefinition{}
+	var operations []*ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		switch def := def.(type) {
+		case *ast.FragmentDefinition:
+			fragments[def.Name.Value] = def
+		case *ast.OperationDefinition:
+			operations = append(operations, def)
+		}
+	}
+
+	for _, op := range operations {
+		if operationName != "" && (op.Name == nil || op.Name.Value != operationName) {
+			continue
+		}
+		c := costCounter{schema: schema, fragments: fragments, visiting: map[string]bool{}}
+		depth, complexity, err := c.selectionSet(schema.QueryType(), op.SelectionSet, 1)
+		if err != nil {
+			return err
+		}
+		if depth > config.GraphQL.MaxDepth {
+			return fmt.Errorf("query is nested %d levels deep, more than the limit of %d", depth,
+				config.GraphQL.MaxDepth)
+		}
+		if complexity > config.GraphQL.MaxComplexity {
+			return fmt.Errorf("query has a complexity of %d, more than the limit of %d", complexity,
+				config.GraphQL.MaxComplexity)
+		}
+	}
+	return nil
+}
+
+type costCounter struct {
+	schema    graphql.Schema
+	fragments map[string]*ast.FragmentDefinition
+	visiting  map[string]bool
+}
+
+func (c costCounter) selectionSet(parent *graphql.Object, set *ast.SelectionSet, depth int) (int, int, error) {
+	if set == nil || parent == nil {
+		return depth - 1, 0, nil
+	}
+	maxDepth := depth
+	complexity := 0
+	add := func(d int, cx int) {
+		if d > maxDepth {
+			maxDepth = d
+		}
+		complexity += cx
+	}
+
+	for _, selection := range set.Selections {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			field, ok := parent.Fields()[selection.Name.Value]
+			if !ok {
+				// not our problem, graphql-go will complain about it
+				continue
+			}
+			child, multiplier := unwrapType(field.Type)
+			d, cx, err := c.selectionSet(child, selection.SelectionSet, depth+1)
+			if err != nil {
+				return 0, 0, err
+			}
+			add(d, 1+multiplier*cx)
+		case *ast.InlineFragment:
+			d, cx, err := c.selectionSet(parent, selection.SelectionSet, depth)
+			if err != nil {
+				return 0, 0, err
+			}
+			add(d, cx)
+		case *ast.FragmentSpread:
+			name := selection.Name.Value
+			fragment, ok := c.fragments[name]
+			if !ok {
+				continue
+			}
+			if c.visiting[name] {
+				return 0, 0, fmt.Errorf("fragment %s spreads itself", name)
+			}
+			c.visiting[name] = true
+			d, cx, err := c.selectionSet(parent, fragment.SelectionSet, depth)
+			delete(c.visiting, name)
+			if err != nil {
+				return 0, 0, err
+			}
+			add(d, cx)
+		}
+	}
+	return maxDepth, complexity, nil
+}
+
+// unwrapType finds the object type a field returns, and how many of them we should assume there
+// are.
+func unwrapType(t graphql.Type) (*graphql.Object, int) {
+	multiplier := 1
+	for {
+		switch wrapped := t.(type) {
+		case *graphql.NonNull:
+			t = wrapped.OfType
+		case *graphql.List:
+			multiplier *= config.GraphQL.ListCost
+			t = wrapped.OfType
+		case *graphql.Object:
+			return wrapped, multiplier
+		default:
+			return nil, multiplier
+		}
+	}
+}
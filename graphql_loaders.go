@@ -0,0 +1,488 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"github.com/lib/pq"
+)
+
+// The GraphQL resolvers don't query the database themselves. Each one asks a loader for what it
+// needs and gets back a thunk; graphql-go doesn't run the thunks until it has resolved everything
+// else at that level of the query, so by then the loader knows every key it will be asked for and
+// can get them all with one query.
+
+// A batchFunc loads everything for keys, returning what it found keyed by key. Missing keys load
+// as nil.
+type batchFunc func(ctx context.Context, keys []string) (map[string]interface{}, error)
+
+type loader struct {
+	batch   batchFunc
+	pending []string
+	queued  map[string]bool
+	results map[string]interface{}
+	errors  map[string]error
+}
+
+func newLoader(batch batchFunc) *loader {
+	return &loader{
+		batch:   batch,
+		queued:  map[string]bool{},
+		results: map[string]interface{}{},
+		errors:  map[string]error{},
+	}
+}
+
+func (l *loader) load(ctx context.Context, key string) func() (interface{}, error) {
+	if !l.queued[key] {
+		l.queued[key] = true
+		l.pending = append(l.pending, key)
+	}
+	return func() (interface{}, error) {
+		l.flush(ctx)
+		return l.results[key], l.errors[key]
+	}
+}
+
+func (l *loader) flush(ctx context.Context) {
+	if len(l.pending) == 0 {
+		return
+	}
+	keys := l.pending
+	l.pending = nil
+	results, err := l.batch(ctx, keys)
+	for _, key := range keys {
+		if err != nil {
+			l.errors[key] = err
+		} else {
+			l.results[key] = results[key]
+		}
+	}
+}
+
+// loaders are per request, so nothing is cached between requests.
+type loaders struct {
+	round                 *loader
+	roundsByGame          *loader
+	playedRoundsBySession *loader
+	judgedRoundsBySession *loader
+	playsByRound          *loader
+	gameStart             *loader
+	session               *loader
+	sessionsByUser        *loader
+	gamesBySession        *loader
+	deck                  *loader
+}
+
+func newLoaders() *loaders {
+	return &loaders{
+		round:                 newLoader(batchRounds(gqlRoundsByIdStmt, "round", false)),
+		roundsByGame:          newLoader(batchRounds(gqlRoundsByGameStmt, "game", true)),
+		playedRoundsBySession: newLoader(batchRounds(gqlPlayedRoundsBySessionStmt, "session", true)),
+		judgedRoundsBySession: newLoader(batchRounds(gqlJudgedRoundsBySessionStmt, "session", true)),
+		playsByRound:          newLoader(batchPlays),
+		gameStart:             newLoader(batchGameStarts),
+		session:               newLoader(batchSessions),
+		sessionsByUser:        newLoader(batchSessionsByUser),
+		gamesBySession:        newLoader(batchGamesBySession),
+		deck:                  newLoader(batchDecks),
+	}
+}
+
+type gqlRound struct {
+	id             string
+	gameId         string
+	judgeSessionId string
+	timestamp      time.Time
+	blackCard      model.Card
+}
+
+type gqlGame struct {
+	id string
+}
+
+type gqlSession struct {
+	id           string
+	persistentId string
+	logIn        time.Time
+}
+
+type gqlUser struct {
+	persistentId string
+}
+
+var gqlRoundsByIdStmt *sql.Stmt
+var gqlRoundsByGameStmt *sql.Stmt
+var gqlPlayedRoundsBySessionStmt *sql.Stmt
+var gqlJudgedRoundsBySessionStmt *sql.Stmt
+var gqlPlaysByRoundStmt *sql.Stmt
+var gqlGameStartsStmt *sql.Stmt
+var gqlSessionsStmt *sql.Stmt
+var gqlSessionsByUserStmt *sql.Stmt
+var gqlGamesBySessionStmt *sql.Stmt
+var gqlDecksStmt *sql.Stmt
+var gqlDeckWhiteCardsStmt *sql.Stmt
+var gqlDeckBlackCardsStmt *sql.Stmt
+
+// Every round query returns the key it was looked up by first, then these.
+const gqlRoundColumns = "rc.round_id, rc.game_id, rc.judge_session_id, ((rc.meta).timestamp AT TIME ZONE 'UTC'), " +
+	"bc.uid, bc.text, bc.watermark, bc.pick, bc.draw "
+
+func prepareLoaderStatements(db *sql.DB) error {
+	var err error
+	prepare := func(query string) *sql.Stmt {
+		if err != nil {
+			return nil
+		}
+		var stmt *sql.Stmt
+		stmt, err = db.Prepare(query)
+		return stmt
+	}
+
+	gqlRoundsByIdStmt = prepare("SELECT rc.round_id, " + gqlRoundColumns +
+		"FROM round_complete rc " +
+		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
+		"WHERE rc.round_id = ANY($1)")
+	gqlRoundsByGameStmt = prepare("SELECT rc.game_id, " + gqlRoundColumns +
+		"FROM round_complete rc " +
+		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
+		"WHERE rc.game_id = ANY($1) " +
+		"ORDER BY ((rc.meta).timestamp) DESC")
+	gqlPlayedRoundsBySessionStmt = prepare("SELECT jt.session_id, " + gqlRoundColumns +
+		"FROM round_complete__user_session__white_card jt " +
+		"JOIN round_complete rc ON rc.uid = jt.round_complete_uid " +
+		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
+		"WHERE jt.session_id = ANY($1) AND jt.white_card_index = 0 " +
+		"ORDER BY ((rc.meta).timestamp) DESC")
+	gqlJudgedRoundsBySessionStmt = prepare("SELECT rc.judge_session_id, " + gqlRoundColumns +
+		"FROM round_complete rc " +
+		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
+		"WHERE rc.judge_session_id = ANY($1) " +
+		"ORDER BY ((rc.meta).timestamp) DESC")
+	gqlPlaysByRoundStmt = prepare("SELECT rc.round_id, jt.session_id, wc.uid, wc.text, wc.watermark, (rc.winner_session_id = jt.session_id) " +
+		"FROM round_complete rc " +
+		"JOIN round_complete__user_session__white_card jt ON jt.round_complete_uid = rc.uid " +
+		"JOIN white_card wc ON wc.uid = jt.white_card_uid " +
+		"WHERE rc.round_id = ANY($1) " +
+		"ORDER BY rc.round_id, jt.session_id, jt.white_card_index ASC")
+	gqlGameStartsStmt = prepare("SELECT game_id, ((meta).timestamp AT TIME ZONE 'UTC') " +
+		"FROM game_start " +
+		"WHERE game_id = ANY($1)")
+	gqlSessionsStmt = prepare("SELECT DISTINCT ON (session_id) session_id, persistent_id, ((meta).timestamp AT TIME ZONE 'UTC') " +
+		"FROM user_session " +
+		"WHERE session_id = ANY($1) " +
+		"ORDER BY session_id, ((meta).timestamp) DESC")
+	gqlSessionsByUserStmt = prepare("SELECT session_id, persistent_id, ((meta).timestamp AT TIME ZONE 'UTC') " +
+		"FROM user_session " +
+		"WHERE persistent_id = ANY($1) " +
+		"ORDER BY ((meta).timestamp) DESC")
+	gqlGamesBySessionStmt = prepare("SELECT DISTINCT jt.session_id, rc.game_id " +
+		"FROM round_complete__user_session__white_card jt " +
+		"JOIN round_complete rc ON rc.uid = jt.round_complete_uid " +
+		"WHERE jt.session_id = ANY($1) AND jt.white_card_index = 0")
+	gqlDecksStmt = prepare(`SELECT DISTINCT ON (id) id, "name", white_count, black_count ` +
+		"FROM deck " +
+		"WHERE id = ANY($1) " +
+		"ORDER BY id, uid DESC")
+	gqlDeckWhiteCardsStmt = prepare("SELECT watermark, uid, text FROM white_card WHERE watermark = ANY($1)")
+	gqlDeckBlackCardsStmt = prepare("SELECT watermark, uid, text, draw, pick FROM black_card WHERE watermark = ANY($1)")
+	return err
+}
+
+// batchRounds loads rounds with a query keyed by something about the round. If many is set, each
+// key can have more than one round.
+func batchRounds(stmt *sql.Stmt, what string, many bool) batchFunc {
+	return func(ctx context.Context, keys []string) (map[string]interface{}, error) {
+		q, err := stmt.QueryContext(ctx, pq.Array(keys))
+		if err != nil {
+			return nil, dbError(err, "Unable to query for rounds by %s.", what)
+		}
+		defer q.Close()
+		ret := map[string]interface{}{}
+		if many {
+			// so keys with no rounds get an empty list instead of null
+			for _, key := range keys {
+				ret[key] = []*gqlRound{}
+			}
+		}
+		for q.Next() {
+			var key string
+			round := &gqlRound{blackCard: model.Card{Meta: model.CardMeta{Color: "black"}}}
+			err = q.Scan(&key, &round.id, &round.gameId, &round.judgeSessionId, &round.timestamp,
+				&round.blackCard.UID, &round.blackCard.Text, &round.blackCard.Watermark, &round.blackCard.Meta.Pick,
+				&round.blackCard.Meta.Draw)
+			if err != nil {
+				return nil, dbError(err, "Unable to read rounds by %s.", what)
+			}
+			if isBlocked("round", round.id) || isBlocked("game", round.gameId) {
+				continue
+			}
+			filterCard(ctx, &round.blackCard)
+			if many {
+				ret[key] = append(ret[key].([]*gqlRound), round)
+			} else {
+				ret[key] = round
+			}
+		}
+		if q.Err() != nil {
+			return nil, dbError(q.Err(), "Unable to read rounds by %s.", what)
+		}
+		return ret, nil
+	}
+}
+
+func batchPlays(ctx context.Context, roundIds []string) (map[string]interface{}, error) {
+	q, err := gqlPlaysByRoundStmt.QueryContext(ctx, pq.Array(roundIds))
+	if err != nil {
+		return nil, dbError(err, "Unable to query for plays.")
+	}
+	defer q.Close()
+	plays := map[string][]model.Play{}
+	for q.Next() {
+		var roundId, sessionId string
+		var winner bool
+		card := model.Card{Meta: model.CardMeta{Color: "white"}}
+		err = q.Scan(&roundId, &sessionId, &card.UID, &card.Text, &card.Watermark, &winner)
+		if err != nil {
+			return nil, dbError(err, "Unable to read plays.")
+		}
+		filterCard(ctx, &card)
+		roundPlays := plays[roundId]
+		if len(roundPlays) == 0 || roundPlays[len(roundPlays)-1].SessionId != sessionId {
+			roundPlays = append(roundPlays, model.Play{SessionId: sessionId, Winner: winner})
+		}
+		play := &roundPlays[len(roundPlays)-1]
+		play.Cards = append(play.Cards, card)
+		plays[roundId] = roundPlays
+	}
+	if q.Err() != nil {
+		return nil, dbError(q.Err(), "Unable to read plays.")
+	}
+	ret := map[string]interface{}{}
+	for _, roundId := range roundIds {
+		if plays[roundId] == nil {
+			ret[roundId] = []model.Play{}
+		} else {
+			ret[roundId] = plays[roundId]
+		}
+	}
+	return ret, nil
+}
+
+func batchGameStarts(ctx context.Context, gameIds []string) (map[string]interface{}, error) {
+	q, err := gqlGameStartsStmt.QueryContext(ctx, pq.Array(gameIds))
+	if err != nil {
+		return nil, dbError(err, "Unable to query for games.")
+	}
+	defer q.Close()
+	ret := map[string]interface{}{}
+	for q.Next() {
+		var gameId string
+		var timestamp time.Time
+		err = q.Scan(&gameId, &timestamp)
+		if err != nil {
+			return nil, dbError(err, "Unable to read games.")
+		}
+		ret[gameId] = timestamp
+	}
+	if q.Err() != nil {
+		return nil, dbError(q.Err(), "Unable to read games.")
+	}
+	return ret, nil
+}
+
+// scanSessions reads sessions, leaving out those of users who opted out of showing their history.
+// There's nothing in the schema for showing only counts, so they're hidden either way.
+func scanSessions(q *sql.Rows, err error) ([]*gqlSession, error) {
+	if err != nil {
+		return nil, dbError(err, "Unable to query for sessions.")
+	}
+	defer q.Close()
+	sessions := []*gqlSession{}
+	for q.Next() {
+		session := &gqlSession{}
+		err = q.Scan(&session.id, &session.persistentId, &session.logIn)
+		if err != nil {
+			return nil, dbError(err, "Unable to read sessions.")
+		}
+		if userOptedOut(session.persistentId) {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	if q.Err() != nil {
+		return nil, dbError(q.Err(), "Unable to read sessions.")
+	}
+	return sessions, nil
+}
+
+func batchSessions(ctx context.Context, sessionIds []string) (map[string]interface{}, error) {
+	sessions, err := scanSessions(gqlSessionsStmt.QueryContext(ctx, pq.Array(sessionIds)))
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]interface{}{}
+	for _, session := range sessions {
+		ret[session.id] = session
+	}
+	return ret, nil
+}
+
+func batchSessionsByUser(ctx context.Context, persistentIds []string) (map[string]interface{}, error) {
+	sessions, err := scanSessions(gqlSessionsByUserStmt.QueryContext(ctx, pq.Array(persistentIds)))
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]interface{}{}
+	for _, persistentId := range persistentIds {
+		ret[persistentId] = []*gqlSession{}
+	}
+	for _, session := range sessions {
+		ret[session.persistentId] = append(ret[session.persistentId].([]*gqlSession), session)
+	}
+	return ret, nil
+}
+
+func batchGamesBySession(ctx context.Context, sessionIds []string) (map[string]interface{}, error) {
+	q, err := gqlGamesBySessionStmt.QueryContext(ctx, pq.Array(sessionIds))
+	if err != nil {
+		return nil, dbError(err, "Unable to query for games by session.")
+	}
+	defer q.Close()
+	ret := map[string]interface{}{}
+	for _, sessionId := range sessionIds {
+		ret[sessionId] = []*gqlGame{}
+	}
+	for q.Next() {
+		var sessionId string
+		game := &gqlGame{}
+		err = q.Scan(&sessionId, &game.id)
+		if err != nil {
+			return nil, dbError(err, "Unable to read games by session.")
+		}
+		if isBlocked("game", game.id) {
+			continue
+		}
+		ret[sessionId] = append(ret[sessionId].([]*gqlGame), game)
+	}
+	if q.Err() != nil {
+		return nil, dbError(q.Err(), "Unable to read games by session.")
+	}
+	return ret, nil
+}
+
+// batchDecks loads decks by ID. IDs have to have been checked with resolveDeckId already.
+func batchDecks(ctx context.Context, codes []string) (map[string]interface{}, error) {
+	ids := []int64{}
+	refsById := map[int64]resolvedDeck{}
+	for _, code := range codes {
+		ref, _ := resolveDeckId(code)
+		if isBlocked("deck", ref.Id) {
+			continue
+		}
+		ids = append(ids, ref.DbId)
+		refsById[ref.DbId] = ref
+	}
+
+	q, err := gqlDecksStmt.QueryContext(ctx, pq.Array(ids))
+	if err != nil {
+		return nil, dbError(err, "Unable to query for decks.")
+	}
+	defer q.Close()
+	decks := map[string]*model.Deck{}
+	// the decks again, by their watermarks, to put their cards in
+	byWatermark := map[string]*model.Deck{}
+	for q.Next() {
+		var id int64
+		deck := &model.Deck{}
+		err = q.Scan(&id, &deck.Name, &deck.WhiteCount, &deck.BlackCount)
+		if err != nil {
+			return nil, dbError(err, "Unable to read decks.")
+		}
+		deck.ID = refsById[id].Id
+		decks[deck.ID] = deck
+		if watermark := refsById[id].Watermark; watermark != "" {
+			byWatermark[watermark] = deck
+		}
+	}
+	if q.Err() != nil {
+		return nil, dbError(q.Err(), "Unable to read decks.")
+	}
+	q.Close()
+
+	found := []string{}
+	for watermark := range byWatermark {
+		found = append(found, watermark)
+	}
+	if len(found) > 0 {
+		q, err = gqlDeckWhiteCardsStmt.QueryContext(ctx, pq.Array(found))
+		if err != nil {
+			return nil, dbError(err, "Unable to query for deck white cards.")
+		}
+		defer q.Close()
+		for q.Next() {
+			card := model.Card{Meta: model.CardMeta{Color: "white"}}
+			err = q.Scan(&card.Watermark, &card.UID, &card.Text)
+			if err != nil {
+				return nil, dbError(err, "Unable to read deck white cards.")
+			}
+			filterCard(ctx, &card)
+			deck := byWatermark[card.Watermark]
+			deck.WhiteCards = append(deck.WhiteCards, card)
+		}
+		if q.Err() != nil {
+			return nil, dbError(q.Err(), "Unable to read deck white cards.")
+		}
+		q.Close()
+
+		q, err = gqlDeckBlackCardsStmt.QueryContext(ctx, pq.Array(found))
+		if err != nil {
+			return nil, dbError(err, "Unable to query for deck black cards.")
+		}
+		defer q.Close()
+		for q.Next() {
+			card := model.Card{Meta: model.CardMeta{Color: "black"}}
+			err = q.Scan(&card.Watermark, &card.UID, &card.Text, &card.Meta.Draw, &card.Meta.Pick)
+			if err != nil {
+				return nil, dbError(err, "Unable to read deck black cards.")
+			}
+			filterCard(ctx, &card)
+			deck := byWatermark[card.Watermark]
+			deck.BlackCards = append(deck.BlackCards, card)
+		}
+		if q.Err() != nil {
+			return nil, dbError(q.Err(), "Unable to read deck black cards.")
+		}
+	}
+
+	ret := map[string]interface{}{}
+	for code, deck := range decks {
+		ret[code] = deck
+	}
+	return ret, nil
+}
@@ -0,0 +1,189 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// how many of the most recent rounds to show on the home page
+const homeRecentRounds = 10
+
+var getHomeCountsStmt *sql.Stmt
+var getHomeRecentRoundsStmt *sql.Stmt
+var lookupIdStmt *sql.Stmt
+
+type homeHandler struct{}
+
+func init() {
+	log.Debug("Registering home handler")
+	registerHandler(homeHandler{})
+}
+
+func (homeHandler) prepareStatements(db *sql.DB) error {
+	var err error
+	getHomeCountsStmt, err = db.Prepare("SELECT " +
+		"  (SELECT COUNT(*) FROM round_complete WHERE ((meta).timestamp AT TIME ZONE 'UTC') >= $1), " +
+		"  (SELECT COUNT(DISTINCT game_id) FROM round_complete WHERE ((meta).timestamp AT TIME ZONE 'UTC') >= $1), " +
+		"  (SELECT COUNT(*) FROM user_session WHERE ((meta).timestamp AT TIME ZONE 'UTC') >= $1)")
+	if err != nil {
+		return err
+	}
+	// $2 and $3 are the blocked rounds and games.
+	getHomeRecentRoundsStmt, err = db.Prepare("SELECT bc.uid, bc.text, bc.watermark, bc.pick, bc.draw, rc.round_id, ((rc.meta).timestamp AT TIME ZONE 'UTC') " +
+		"FROM round_complete rc " +
+		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
+		"WHERE NOT (rc.round_id = ANY($2)) AND NOT (rc.game_id = ANY($3)) " +
+		"ORDER BY ((rc.meta).timestamp) DESC " +
+		"LIMIT $1")
+	if err != nil {
+		return err
+	}
+	lookupIdStmt, err = db.Prepare("SELECT " +
+		"  EXISTS(SELECT 1 FROM user_session WHERE session_id = $1), " +
+		"  EXISTS(SELECT 1 FROM round_complete WHERE round_id = $1), " +
+		"  EXISTS(SELECT 1 FROM game_start WHERE game_id = $1), " +
+		"  EXISTS(SELECT 1 FROM user_session WHERE persistent_id = $1)")
+	return err
+}
+
+func (homeHandler) registerEndpoints(r *gin.Engine) {
+	log.Debug("Registering endpoints for home handler")
+	r.GET("/", getHome)
+	r.GET("/lookup", lookupId)
+}
+
+func getHome(c *gin.Context) {
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	home, err := loadHome(ctx)
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(200, "home", &home)
+	} else {
+		c.JSON(200, home)
+	}
+}
+
+func loadHome(ctx context.Context) (model.Home, error) {
+	home := model.Home{RecentRounds: []model.RoundMeta{}}
+	since := time.Now().UTC().Add(-24 * time.Hour)
+	err := getHomeCountsStmt.QueryRowContext(ctx, since).Scan(&home.Rounds, &home.Games, &home.Sessions)
+	if err != nil {
+		return model.Home{}, dbError(err, "Unable to query for recent activity.")
+	}
+
+	q, err := getHomeRecentRoundsStmt.QueryContext(ctx, homeRecentRounds, pq.Array(blockedIds("round")),
+		pq.Array(blockedIds("game")))
+	if err != nil {
+		return model.Home{}, dbError(err, "Unable to query for recent rounds.")
+	}
+	defer q.Close()
+	for q.Next() {
+		round := model.RoundMeta{BlackCard: model.Card{Meta: model.CardMeta{Color: "black"}}}
+		card := &round.BlackCard
+		var timestamp time.Time
+		err = q.Scan(&card.UID, &card.Text, &card.Watermark, &card.Meta.Pick, &card.Meta.Draw, &round.RoundId,
+			&timestamp)
+		if err != nil {
+			return model.Home{}, dbError(err, "Unable to read recent rounds.")
+		}
+		filterCard(ctx, card)
+		round.Timestamp = timestamp.Unix()
+		home.RecentRounds = append(home.RecentRounds, round)
+	}
+	if q.Err() != nil {
+		return model.Home{}, dbError(q.Err(), "Unable to read recent rounds.")
+	}
+	return home, nil
+}
+
+// lookupId sends the client to the page for whatever has the ID it asked about.
+func lookupId(c *gin.Context) {
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	lookup, err := resolveId(ctx, strings.TrimSpace(c.Query("id")))
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+	c.Redirect(302, lookup.Path)
+}
+
+// resolveId works out what an ID belongs to. IDs don't say what they are, so this goes by their
+// shape first and then checks the database.
+func resolveId(ctx context.Context, id string) (model.Lookup, error) {
+	if id == "" {
+		return model.Lookup{}, badIdError("Enter an ID to look up.")
+	} else if !idPattern.MatchString(id) {
+		return model.Lookup{}, badIdError("'%s' is not an ID for anything.", id)
+	}
+
+	var session, round, game, user bool
+	err := lookupIdStmt.QueryRowContext(ctx, id).Scan(&session, &round, &game, &user)
+	if err != nil {
+		return model.Lookup{}, dbError(err, "Unable to look up id %s.", id)
+	}
+
+	kind := ""
+	switch {
+	// session IDs start with the server they're on, like SessionBasics.ServerId expects
+	case session && strings.Contains(id, "_"):
+		kind = "session"
+	case round:
+		kind = "round"
+	case game:
+		kind = "game"
+	case session:
+		kind = "session"
+	case user && !userLinksSigned():
+		kind = "user"
+	default:
+		// nothing else looks like a deck ID, and the deck page can say whether there's anything there
+		if deck, err := resolveDeckId(id); err == nil {
+			kind = "deck"
+			id = deck.Id
+		}
+	}
+	if kind == "" {
+		return model.Lookup{}, notFoundError("Nothing has the id %s.", id)
+	}
+	return model.Lookup{
+		Kind: kind,
+		Id:   id,
+		Path: "/" + kind + "/" + url.PathEscape(id),
+	}, nil
+}
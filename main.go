@@ -24,6 +24,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"html/template"
@@ -31,8 +32,12 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/ajanata/pyx-metrics-viewer/api"
+	"github.com/ajanata/pyx-metrics-viewer/model"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
 	_ "github.com/lib/pq"
 	"github.com/op/go-logging"
 )
@@ -46,6 +51,17 @@ type endpointHandler interface {
 	registerEndpoints(*gin.Engine)
 }
 
+// backgroundHandler is implemented by handlers that have work to do while the server is running.
+type backgroundHandler interface {
+	runInBackground()
+}
+
+// adminHandler is implemented by handlers with endpoints in the admin area. Their paths are relative
+// to /admin, and they have to check the user's role themselves.
+type adminHandler interface {
+	registerAdminEndpoints(*gin.RouterGroup)
+}
+
 var handlers []endpointHandler
 
 func registerHandler(handler endpointHandler) {
@@ -53,68 +69,195 @@ func registerHandler(handler endpointHandler) {
 }
 
 func main() {
-	config = loadConfig()
+	configPath, args := configFlag(os.Args[1:])
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") && args[0] != "serve" {
+		os.Exit(runCommand(configPath, args))
+	}
+	if len(args) > 0 && args[0] == "serve" {
+		args = args[1:]
+	}
+
+	config = loadConfig(configPath, args)
+	if _, err := setUp(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if config.RunDebugServer {
+		go func() {
+			log.Info(http.ListenAndServe("localhost:4680", nil))
+		}()
+	}
 
+	r := newRouter()
+	for _, handler := range handlers {
+		if bg, ok := handler.(backgroundHandler); ok {
+			go bg.runInBackground()
+		}
+	}
+	r.Run(":4080")
+}
+
+// newRouter sets up a router with every handler's endpoints, and the admin pages if anyone can use
+// them.
+func newRouter() *gin.Engine {
+	r := gin.Default()
+
+	r.SetFuncMap(templateFuncs)
+	r.LoadHTMLGlob("templates/*")
+	r.Static("/static", "static")
+	r.NoRoute(func(c *gin.Context) {
+		returnError(c, notFoundError("There is nothing at %s.", c.Request.URL.Path))
+	})
+	for _, handler := range handlers {
+		handler.registerEndpoints(r)
+	}
+	if len(config.Admin.Users) > 0 {
+		admin := r.Group("/admin", adminAuth)
+		for _, handler := range handlers {
+			if ah, ok := handler.(adminHandler); ok {
+				ah.registerAdminEndpoints(admin)
+			}
+		}
+	}
+	return r
+}
+
+// setUp configures logging and gets the handlers ready to query the database. It's needed both to
+// serve and to run commands.
+func setUp() (*sql.DB, error) {
 	backendStdErr := logging.NewLogBackend(os.Stderr, "", 0)
 	formattedStdErr := logging.NewBackendFormatter(backendStdErr, logFormat)
 	stdErrLeveled := logging.AddModuleLevel(formattedStdErr)
 	level, err := logging.LogLevel(config.LogLevel)
 	if err != nil {
-		fmt.Printf("Unable to configure logging: %s", err)
-		return
+		return nil, fmt.Errorf("Unable to configure logging: %s", err)
 	}
 	stdErrLeveled.SetLevel(level, "")
 	logging.SetBackend(stdErrLeveled)
 
-	if config.RunDebugServer {
-		go func() {
-			log.Info(http.ListenAndServe("localhost:4680", nil))
-		}()
-	}
-
 	// TODO not suck
 	connStr := fmt.Sprintf("user=%s password=%s dbname=%s host=%s sslmode=disable",
 		config.Database.Username, config.Database.Password, config.Database.DbName,
 		config.Database.Host)
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
-		log.Errorf("Unable to connect to db: %v", err)
-		return
+		return nil, fmt.Errorf("Unable to connect to db: %v", err)
 	}
 
 	// prepare statements
 	for _, handler := range handlers {
 		err = handler.prepareStatements(db)
 		if err != nil {
-			log.Errorf("Unable to prepare statement: %v", err)
-			return
+			return nil, fmt.Errorf("Unable to prepare statement: %v", err)
 		}
 	}
+	return db, nil
+}
 
-	// configure router
-	r := gin.Default()
+var templateFuncs = template.FuncMap{
+	"cardHtml":  cardHtml,
+	"errorCard": errorCard,
+	"logLevels": func() []string {
+		return []string{"CRITICAL", "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG"}
+	},
+	"percent":       percent,
+	"rank":          rank,
+	"watermarkDeck": resolveWatermark,
+	"reportReasons": func() []string {
+		return reportReasons
+	},
+	"reportTarget": func(kind string, id string) model.ReportTarget {
+		return model.ReportTarget{Kind: kind, Id: id}
+	},
+	"topListNames": func() []string {
+		return topListNames
+	},
+	"topWindowNames": func() []string {
+		return topWindowNames
+	},
+	"userLink":        userLink,
+	"userLinksSigned": userLinksSigned,
+}
 
-	r.SetFuncMap(template.FuncMap{
-		"noescape": noescape,
-	})
-	r.LoadHTMLGlob("templates/*")
-	r.Static("/static", "static")
-	// register all handlers
-	for _, handler := range handlers {
-		handler.registerEndpoints(r)
-	}
-	r.Run(":4080")
+// cardHtml puts card text on a page as it is. Card text is sanitized by filterCard as it's loaded,
+// which is the only place it's done, so nothing else can be passed to this.
+func cardHtml(text string) template.HTML {
+	return template.HTML(text)
 }
 
-func noescape(value interface{}) template.HTML {
-	return template.HTML(fmt.Sprint(value))
+func percent(fraction float64) string {
+	return fmt.Sprintf("%.1f%%", fraction*100)
 }
 
-func returnError(c *gin.Context, status int, msg string) {
-	log.Errorf("Returning error (%d) for request (%s): %s", status, c.Request.URL, msg)
+// rank turns a zero-based index into a position in a list.
+func rank(index int) int {
+	return index + 1
+}
+
+// errorCard is a blank card for the error page to say something on.
+func errorCard(color string) model.Card {
+	return model.Card{Meta: model.CardMeta{Color: color}}
+}
+
+func returnError(c *gin.Context, err error) {
 	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
-		c.String(status, msg)
+		p := logAndDescribeError(c, err)
+		c.HTML(p.Status, "error", &p)
 	} else {
-		c.JSON(status, gin.H{"error": msg})
+		returnProblem(c, err)
 	}
 }
+
+// returnProblem always responds with problem details, no matter what the client asked for.
+func returnProblem(c *gin.Context, err error) {
+	p := logAndDescribeError(c, err)
+	c.Render(p.Status, problemRender{p})
+}
+
+func logAndDescribeError(c *gin.Context, err error) api.Problem {
+	kind := errorKinds[kindOf(err)]
+	if kind.status >= 500 {
+		log.Errorf("Returning error (%d) for request (%s): %v", kind.status, c.Request.URL, err)
+	} else {
+		log.Infof("Returning error (%d) for request (%s): %v", kind.status, c.Request.URL, err)
+	}
+	p := api.Problem{
+		Type:     kind.problemType,
+		Title:    kind.title,
+		Status:   kind.status,
+		Detail:   publicDetail(err),
+		Instance: c.Request.URL.RequestURI(),
+	}
+	p.Error = p.Detail
+	return p
+}
+
+// problemRender is gin's JSON renderer, with the RFC 7807 content type.
+type problemRender struct {
+	problem api.Problem
+}
+
+func (r problemRender) Render(w http.ResponseWriter) error {
+	r.WriteContentType(w)
+	return render.JSON{Data: r.problem}.Render(w)
+}
+
+func (r problemRender) WriteContentType(w http.ResponseWriter) {
+	w.Header()["Content-Type"] = []string{"application/problem+json; charset=utf-8"}
+}
+
+// queryContext bounds how long a request can spend waiting on the database. It also says whether
+// card text should be plain text, which only JSON responses can ask for with text=plain. Pages always
+// get sanitized HTML, since cardHtml puts it on them without escaping it.
+func queryContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	ctx := c.Request.Context()
+	if c.Query("text") == "plain" && !strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		ctx = withPlainText(ctx)
+	}
+	return context.WithTimeout(ctx, queryTimeout())
+}
+
+func queryTimeout() time.Duration {
+	return time.Duration(config.Database.QueryTimeout) * time.Second
+}
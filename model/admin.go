@@ -0,0 +1,67 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package model
+
+// AdminSession is who is using the admin pages, and what they can do there.
+type AdminSession struct {
+	User string
+	// Roles are moderator, operator, or both.
+	Roles []string
+	// CSRF has to be sent back with every form.
+	CSRF string
+}
+
+func (session AdminSession) HasRole(role string) bool {
+	for _, r := range session.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminHome is the index of the admin pages.
+type AdminHome struct {
+	Admin AdminSession `json:"-"`
+	// Pages are the paths of the pages the user can use, under /admin.
+	Pages []string
+}
+
+// BlocklistPage is everything on the blocklist, for moderators to look over.
+type BlocklistPage struct {
+	Admin   AdminSession `json:"-"`
+	Entries []Block
+}
+
+// RuntimeConfig is the part of the config that operators can change while the viewer is running.
+// Changes are lost when it restarts.
+type RuntimeConfig struct {
+	Admin    AdminSession `json:"-"`
+	LogLevel string
+	Filter   FilterRules
+	// WatermarkCacheSize is how many decks' names are cached.
+	WatermarkCacheSize int
+	// TopCacheSize is how many of the /top lists are cached.
+	TopCacheSize int
+}
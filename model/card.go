@@ -0,0 +1,96 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package model
+
+import (
+	"time"
+)
+
+type PickStats struct {
+	Pick   int16
+	Rounds int
+	Wins   int
+}
+
+// CardRound is a round a card was in, from the point of view of that card.
+type CardRound struct {
+	RoundId   string
+	Timestamp int64
+	BlackCard Card
+	// Won is whether the play the card was in won. Always false for black cards.
+	Won bool
+}
+
+type CardStats struct {
+	Card Card
+	// Rounds is how many rounds a white card was played in, or a black card was shown in.
+	Rounds int
+	Wins   int
+	// ByPick breaks down the rounds a white card was played in by the pick of the black card.
+	ByPick       []PickStats
+	RecentRounds []CardRound
+}
+
+func (stats *PickStats) WinRate() float64 {
+	if stats.Rounds == 0 {
+		return 0
+	}
+	return float64(stats.Wins) / float64(stats.Rounds)
+}
+
+func (stats *CardStats) WinRate() float64 {
+	if stats.Rounds == 0 {
+		return 0
+	}
+	return float64(stats.Wins) / float64(stats.Rounds)
+}
+
+func (round *CardRound) FormattedTimestamp() string {
+	return time.Unix(round.Timestamp, 0).UTC().Format(time.RFC1123)
+}
+
+// Answer is a combination of white cards that was played with a particular black card.
+type Answer struct {
+	Cards []Card
+	Plays int
+	Wins  int
+	// ExampleRoundIds are some of the rounds the answer won.
+	ExampleRoundIds []string
+}
+
+type BlackCardAnswers struct {
+	BlackCard Card
+	// SortedBy is either "wins" or "rate".
+	SortedBy string
+	// MinPlays is how many times an answer has to have been played to be ranked.
+	MinPlays int
+	Answers  []Answer
+}
+
+func (answer *Answer) WinRate() float64 {
+	if answer.Plays == 0 {
+		return 0
+	}
+	return float64(answer.Wins) / float64(answer.Plays)
+}
@@ -0,0 +1,153 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package model
+
+import (
+	"time"
+)
+
+// DeckFilter picks out and orders the cards in a deck. The zero value is every card, unsorted, on
+// one page.
+type DeckFilter struct {
+	// Text must be somewhere in the card's text, ignoring case.
+	Text string
+	// Color is "black", "white", or empty for both.
+	Color string
+	// Pick and Draw only match black cards, and 0 matches anything.
+	Pick int16
+	Draw int16
+	// Sort is "text", "usage" (most played first), or empty for the order the database has them in.
+	// Cards only have their Uses when sorting by usage.
+	Sort string
+	// Page starts at 1. If PageSize is 0, there is only one page.
+	Page     int
+	PageSize int
+}
+
+type Deck struct {
+	Name       string
+	ID         string
+	WhiteCount int
+	BlackCount int
+	WhiteCards []Card
+	BlackCards []Card
+	Filter     DeckFilter
+	// MatchingWhite and MatchingBlack are how many cards matched the filter, on every page.
+	MatchingWhite int
+	MatchingBlack int
+	Pages         int
+}
+
+// PrevPage is the page before this one, or 0 if this is the first.
+func (deck *Deck) PrevPage() int {
+	if deck.Filter.Page <= 1 {
+		return 0
+	}
+	return deck.Filter.Page - 1
+}
+
+// NextPage is the page after this one, or 0 if this is the last.
+func (deck *Deck) NextPage() int {
+	if deck.Filter.Page >= deck.Pages {
+		return 0
+	}
+	return deck.Filter.Page + 1
+}
+
+// DeckVersion is a run of rows in the deck table that all had the same name and counts.
+type DeckVersion struct {
+	Name       string
+	WhiteCount int
+	BlackCount int
+	// WhiteChange and BlackChange are how the counts changed from the version before.
+	WhiteChange int
+	BlackChange int
+	// FirstSeen and LastSeen are when the first and last rows for this version were recorded, and
+	// Loads is how many rows there were.
+	FirstSeen int64
+	LastSeen  int64
+	Loads     int
+	// NewCards are the cards that were first played while this was the latest version.
+	NewCards []Card
+}
+
+type DeckHistory struct {
+	ID       string
+	Versions []DeckVersion
+}
+
+func (version *DeckVersion) FormattedFirstSeen() string {
+	return time.Unix(version.FirstSeen, 0).UTC().Format(time.RFC1123)
+}
+
+func (version *DeckVersion) FormattedLastSeen() string {
+	return time.Unix(version.LastSeen, 0).UTC().Format(time.RFC1123)
+}
+
+// DeckUsage is how much a deck was used in one month.
+type DeckUsage struct {
+	// Month is the first day of the month, formatted like 2006-01.
+	Month       string
+	BlackRounds int
+	WhitePlays  int
+}
+
+type DeckStats struct {
+	ID   string
+	Name string
+	// BlackRounds is how many rounds used one of the deck's black cards.
+	BlackRounds int
+	// WhitePlays and WhiteWins are the plays that had one of the deck's white cards in them, and
+	// OtherPlays and OtherWins are every other play in the same rounds.
+	WhitePlays int
+	WhiteWins  int
+	OtherPlays int
+	OtherWins  int
+	Usage      []DeckUsage
+	// MinPlays is how many times a card has to have been played to be one of the best or worst.
+	MinPlays   int
+	BestCards  []TopWhiteCard
+	WorstCards []TopWhiteCard
+}
+
+func (stats *DeckStats) WinRate() float64 {
+	if stats.WhitePlays == 0 {
+		return 0
+	}
+	return float64(stats.WhiteWins) / float64(stats.WhitePlays)
+}
+
+func (stats *DeckStats) OtherWinRate() float64 {
+	if stats.OtherPlays == 0 {
+		return 0
+	}
+	return float64(stats.OtherWins) / float64(stats.OtherPlays)
+}
+
+// DeckRef is what a watermark resolved to.
+type DeckRef struct {
+	// Id is for /deck/:id, or empty if there isn't a page for the deck.
+	Id   string
+	Name string
+}
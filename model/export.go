@@ -0,0 +1,57 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package model
+
+// ExportSession is one of a user's sessions, in their data export.
+type ExportSession struct {
+	SessionId      string
+	Player         string
+	LogInTimestamp int64
+}
+
+// ExportRound is a round a user's session played in or judged, in their data export.
+type ExportRound struct {
+	RoundId   string
+	GameId    string
+	Timestamp int64
+	SessionId string
+	Player    string
+	// Role is played or judged.
+	Role string
+	Won  bool
+	// BlackCard and WhiteCards are filtered like they are everywhere else, as sanitized HTML unless
+	// the export was asked for with text=plain.
+	BlackCard string
+	// WhiteCards are what the session played, or for a round it judged, what it picked.
+	WhiteCards []string
+}
+
+// ExportGame is a game a user's session played in, in their data export.
+type ExportGame struct {
+	GameId    string
+	SessionId string
+	Player    string
+	// StartTimestamp is 0 if there's no record of the game starting.
+	StartTimestamp int64 `json:",omitempty"`
+}
@@ -0,0 +1,95 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package model
+
+import (
+	"time"
+)
+
+// FilteredCard is a card that has been filtered when it was shown, and how often.
+type FilteredCard struct {
+	// Card has the card's text before it was filtered.
+	Card Card
+	// Rules are every rule the card has been filtered for.
+	Rules   []string
+	Hits    int64
+	LastHit time.Time
+}
+
+type FilterRuleHits struct {
+	Rule string
+	Hits int64
+}
+
+// FilterRules are a set of filter rules, as they're written in the config.
+type FilterRules struct {
+	Rules []string
+	Allow []string
+	Mode  string
+}
+
+type FilterDashboard struct {
+	Admin AdminSession `json:"-"`
+	// Since is when filter hits started being recorded.
+	Since time.Time
+	// Cards are the most often filtered cards, most first.
+	Cards []FilteredCard
+	// Rules are every rule that has filtered something, most first.
+	Rules []FilterRuleHits
+	// Current are the rules in use.
+	Current FilterRules
+	// Test is the result of trying out other rules, if that was asked for.
+	Test *FilterTest
+}
+
+func (dashboard *FilterDashboard) FormattedSince() string {
+	return dashboard.Since.UTC().Format(time.RFC1123)
+}
+
+// FilterTest is how proposed filter rules would change what's filtered, going by every card that is
+// stored.
+type FilterTest struct {
+	Proposed FilterRules
+	// Checked is how many cards were checked.
+	Checked int
+	// NewlyFiltered are cards that would be filtered but aren't now, with the proposed rules they
+	// match. There may be more than are listed.
+	NewlyFiltered      []FilterTestCard
+	NewlyFilteredCount int
+	// NewlyUnfiltered are cards that are filtered now but wouldn't be, with the current rules they
+	// match. There may be more than are listed.
+	NewlyUnfiltered      []FilterTestCard
+	NewlyUnfilteredCount int
+}
+
+type FilterTestCard struct {
+	Card  Card
+	Rules []string
+	// Result is what the card would be shown as with the proposed rules.
+	Result string
+}
+
+func (card *FilteredCard) FormattedLastHit() string {
+	return card.LastHit.UTC().Format(time.RFC1123)
+}
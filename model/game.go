@@ -0,0 +1,66 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package model
+
+import (
+	"time"
+)
+
+type RoundMeta struct {
+	RoundId   string
+	Timestamp int64
+	BlackCard Card
+}
+
+// Game is a game's completed rounds and how each player did. Only the rounds are in the negotiated
+// JSON, which consumers have come to depend on. /api/v1 has the scoreboard.
+type Game struct {
+	GameId string
+	Rounds []RoundMeta
+	// Scoreboard is most wins first.
+	Scoreboard []Score
+}
+
+// Score is how one player did in a game. Players are only shown by their pseudonyms.
+type Score struct {
+	Player string
+	Played int
+	Won    int
+	Judged int
+}
+
+type GameMeta struct {
+	GameId    string
+	Timestamp int64
+}
+
+func (round *RoundMeta) FormattedTimestamp() string {
+	//	return time.Unix(round.Timestamp, 0).UTC().Format("Mon, 02 Jan 2006 15:04:05") + " PDT -0700"
+	return time.Unix(round.Timestamp, 0).UTC().Format(time.RFC1123)
+}
+
+func (game *GameMeta) FormattedTimestamp() string {
+	//	return time.Unix(game.Timestamp, 0).UTC().Format("Mon, 02 Jan 2006 15:04:05") + " PDT -0700"
+	return time.Unix(game.Timestamp, 0).UTC().Format(time.RFC1123)
+}
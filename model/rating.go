@@ -0,0 +1,64 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package model
+
+import (
+	"time"
+)
+
+// CardRating is how strong a white card is, going by which plays it beat and lost to.
+type CardRating struct {
+	UID       int64
+	Watermark string
+	Rating    float64
+	Rounds    int
+	Wins      int
+}
+
+type RatedCard struct {
+	Card   Card
+	Rating float64
+	Rounds int
+	Wins   int
+}
+
+type Leaderboard struct {
+	// Watermark is the deck the leaderboard is limited to, or empty for every deck.
+	Watermark string
+	// MinRounds is how many rounds a card has to have been in to be on the leaderboard.
+	MinRounds int
+	// Watermarks is every watermark that has a card on the overall leaderboard.
+	Watermarks []string
+	// RatedRounds is how many rounds the ratings are based on.
+	RatedRounds int64
+	UpdatedAt   time.Time
+	Cards       []RatedCard
+}
+
+func (leaderboard *Leaderboard) FormattedUpdatedAt() string {
+	if leaderboard.UpdatedAt.IsZero() {
+		return "never"
+	}
+	return leaderboard.UpdatedAt.UTC().Format(time.RFC1123)
+}
@@ -0,0 +1,79 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package model
+
+import (
+	"time"
+)
+
+// Report is someone flagging a round or deck for the moderators to look at.
+type Report struct {
+	Id int64
+	// Kind is round or deck.
+	Kind     string
+	EntityId string
+	Reason   string
+	Details  string
+	// ReporterHash tells reports from the same address apart without keeping the address.
+	ReporterHash string
+	Created      time.Time
+	// Status is open until a moderator decides what to do about it, and then dismissed or hidden.
+	Status    string
+	DecidedAt time.Time
+}
+
+func (report *Report) FormattedCreated() string {
+	return report.Created.UTC().Format(time.RFC1123)
+}
+
+// ReportedItem is a round or deck with the open reports about it.
+type ReportedItem struct {
+	Kind    string
+	Id      string
+	Reports []Report
+}
+
+type ReviewQueue struct {
+	Admin AdminSession `json:"-"`
+	// Items are oldest report first.
+	Items []ReportedItem
+}
+
+// ReportTarget is what a report form is about.
+type ReportTarget struct {
+	Kind string
+	Id   string
+}
+
+// AuditEntry records a moderator's or operator's decision.
+type AuditEntry struct {
+	Time time.Time
+	// Admin is who made it.
+	Admin string
+	// Action is what was done: dismiss, hide, block, unblock, purge, or configure.
+	Action string
+	Kind   string
+	Id     string
+	Reason string `json:",omitempty"`
+}
@@ -0,0 +1,72 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package model has the types the viewer renders its pages from, which are also what the
+// content-negotiated routes (/round/:id and friends) return as JSON. Those can change whenever the
+// pages need them to; package api has the types for the stable /api/v1 routes.
+package model
+
+import (
+	"time"
+)
+
+type CardMeta struct {
+	Color string
+	Draw  int16 `json:",omitempty"`
+	Pick  int16 `json:",omitempty"`
+}
+
+type Card struct {
+	UID       int64 `json:",omitempty"`
+	Text      string
+	Watermark string
+	Meta      CardMeta
+	// Uses is how many times the card was played, if that was looked up.
+	Uses int `json:",omitempty"`
+}
+
+type Play struct {
+	SessionId string
+	// Player is the session's pseudonym.
+	Player string
+	Winner bool
+	Cards  []Card
+}
+
+type Round struct {
+	GameId      string
+	BlackCard   Card
+	WinningPlay []Card
+	OtherPlays  [][]Card
+	Timestamp   int64
+	// These aren't in the negotiated JSON, which consumers have come to depend on. /api/v1 has them.
+	RoundId        string `json:"-"`
+	JudgeSessionId string `json:"-"`
+	Judge          string `json:"-"`
+	Plays          []Play `json:"-"`
+}
+
+func (round *Round) FormattedTimestamp() string {
+	//	return time.Unix(round.Timestamp, 0).UTC().Format("Mon, 02 Jan 2006 15:04:05") + " PDT -0700"
+	return time.Unix(round.Timestamp, 0).UTC().Format(time.RFC1123)
+}
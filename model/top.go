@@ -0,0 +1,80 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package model
+
+import (
+	"time"
+)
+
+type TopBlackCard struct {
+	Card   Card
+	Rounds int
+}
+
+type TopWhiteCard struct {
+	Card  Card
+	Plays int
+	Wins  int
+}
+
+// TopCombination is a black card and the white cards that won with it.
+type TopCombination struct {
+	BlackCard  Card
+	WhiteCards []Card
+	Wins       int
+}
+
+type TopUser struct {
+	PersistentId string
+	Rounds       int
+}
+
+type TopGame struct {
+	GameId string
+	Rounds int
+}
+
+// TopLists are the leaderboards for one window of time. Lists that weren't asked for are nil.
+type TopLists struct {
+	// List is which list was asked for, or empty for some of each of them.
+	List string
+	// Window is one of "day", "week", "month", or "all".
+	Window string
+	// Since is when the window starts, or the zero time for all time.
+	Since time.Time
+	// MinPlays is how many times a white card has to have been played to be in WhiteCards.
+	MinPlays     int
+	BlackCards   []TopBlackCard
+	WhiteCards   []TopWhiteCard
+	Combinations []TopCombination
+	Users        []TopUser
+	Games        []TopGame
+}
+
+func (card *TopWhiteCard) WinRate() float64 {
+	if card.Plays == 0 {
+		return 0
+	}
+	return float64(card.Wins) / float64(card.Plays)
+}
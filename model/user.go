@@ -0,0 +1,55 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+type SessionBasics struct {
+	SessionId      string
+	LogInTimestamp int64
+}
+
+type UserMeta struct {
+	Sessions []SessionBasics
+	// Hidden is set when the user opted out of showing their history. There are no sessions, only
+	// how many there were and how many rounds they played and judged.
+	Hidden           bool `json:",omitempty"`
+	SessionCount     int  `json:",omitempty"`
+	PlayedRoundCount int  `json:",omitempty"`
+	JudgedRoundCount int  `json:",omitempty"`
+	// ExportLink is where to download everything about the user, if they can be.
+	ExportLink string `json:"-"`
+}
+
+func (session *SessionBasics) FormattedTimestamp() string {
+	//	return time.Unix(session.LogInTimestamp, 0).UTC().Format("Mon, 02 Jan 2006 15:04:05") + " PDT -0700"
+	return time.Unix(session.LogInTimestamp, 0).UTC().Format(time.RFC1123)
+}
+
+func (session *SessionBasics) ServerId() string {
+	return strings.Split(session.SessionId, "_")[0]
+}
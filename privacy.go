@@ -0,0 +1,193 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// how often to look up the sessions of users who have opted out, to catch their new ones
+const optOutRefreshInterval = time.Minute
+
+var getOptedOutSessionsStmt *sql.Stmt
+
+type privacyHandler struct{}
+
+// optedOutSessions are the sessions of the users in config.Privacy.OptOut, so that their plays can
+// be told apart without looking each one up.
+var optedOutSessions = struct {
+	sync.RWMutex
+	ids map[string]bool
+}{
+	ids: map[string]bool{},
+}
+
+func init() {
+	log.Debug("Registering privacy handler")
+	registerHandler(privacyHandler{})
+}
+
+func (privacyHandler) prepareStatements(db *sql.DB) error {
+	log.Debug("Preparing statements for privacy handler")
+	if mode := config.Privacy.OptOutMode; mode != "hide" && mode != "aggregate" {
+		return fmt.Errorf("unknown opt-out mode %s", mode)
+	}
+	var err error
+	pseudonymKey, err = loadOrCreateKey(pseudonymKeyFile)
+	if err != nil {
+		return err
+	}
+	getOptedOutSessionsStmt, err = db.Prepare("SELECT DISTINCT session_id " +
+		"FROM user_session " +
+		"WHERE persistent_id = ANY($1)")
+	if err != nil {
+		return err
+	}
+	return loadOptedOutSessions()
+}
+
+func (privacyHandler) registerEndpoints(*gin.Engine) {
+	// privacy is enforced by the other handlers
+}
+
+func (privacyHandler) runInBackground() {
+	if len(config.Privacy.OptOut) == 0 {
+		return
+	}
+	for {
+		time.Sleep(optOutRefreshInterval)
+		if err := loadOptedOutSessions(); err != nil {
+			log.Errorf("Unable to look up the sessions of users who opted out, keeping the old ones: %v", err)
+		}
+	}
+}
+
+func loadOptedOutSessions() error {
+	if len(config.Privacy.OptOut) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout())
+	defer cancel()
+	q, err := getOptedOutSessionsStmt.QueryContext(ctx, pq.Array(config.Privacy.OptOut))
+	if err != nil {
+		return dbError(err, "Unable to query for the sessions of users who opted out.")
+	}
+	defer q.Close()
+	ids := map[string]bool{}
+	for q.Next() {
+		var id string
+		if err = q.Scan(&id); err != nil {
+			return dbError(err, "Unable to read the sessions of users who opted out.")
+		}
+		ids[id] = true
+	}
+	if q.Err() != nil {
+		return dbError(q.Err(), "Unable to read the sessions of users who opted out.")
+	}
+	optedOutSessions.Lock()
+	optedOutSessions.ids = ids
+	optedOutSessions.Unlock()
+	return nil
+}
+
+func userOptedOut(persistentId string) bool {
+	return containsString(config.Privacy.OptOut, persistentId)
+}
+
+func sessionOptedOut(sessionId string) bool {
+	optedOutSessions.RLock()
+	defer optedOutSessions.RUnlock()
+	return optedOutSessions.ids[sessionId]
+}
+
+// hideOptedOut is whether users who opted out are treated as if they never played, rather than
+// having their sessions shown as counts.
+func hideOptedOut() bool {
+	return config.Privacy.OptOutMode == "hide"
+}
+
+// userLinksSigned is whether user pages can only be reached with a link signed by the PYX server.
+func userLinksSigned() bool {
+	return config.Privacy.UserLinkKey != ""
+}
+
+// userLinkSignature is the sig for a link to a user page. expires is a Unix time, or empty for a
+// link that doesn't expire.
+func userLinkSignature(persistentId string, expires string) string {
+	mac := hmac.New(sha256.New, []byte(config.Privacy.UserLinkKey))
+	mac.Write([]byte(persistentId + ":" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkUserLink makes sure that a request for a user's page came from a signed link, if it has to.
+func checkUserLink(c *gin.Context, persistentId string) error {
+	if !userLinksSigned() {
+		return nil
+	}
+	expires := c.Query("expires")
+	if expires != "" {
+		t, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return badRequestError("'%s' is not a time for a link to expire.", expires)
+		}
+		if time.Now().Unix() > t {
+			return newError(errForbidden, "This link has expired. Get a new one from the game.")
+		}
+	}
+	if !hmac.Equal([]byte(strings.ToLower(c.Query("sig"))), []byte(userLinkSignature(persistentId, expires))) {
+		return newError(errForbidden, "User pages can only be seen through a link from the game.")
+	}
+	return nil
+}
+
+// userLink is the path to a user's page, signed if it has to be, for other pages to link to.
+func userLink(persistentId string) string {
+	path := "user/" + url.PathEscape(persistentId)
+	if userLinksSigned() {
+		path += "?sig=" + userLinkSignature(persistentId, "")
+	}
+	return path
+}
+
+// visibleSessionId is a session ID as it's shown next to a play or a judged round, which is not at
+// all if they're redacted or the session's user opted out.
+func visibleSessionId(id string) string {
+	if config.Privacy.RedactSessionIds || sessionOptedOut(id) {
+		return ""
+	}
+	return id
+}
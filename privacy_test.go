@@ -0,0 +1,102 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckUserLink(t *testing.T) {
+	config = &Config{}
+	config.ensureDefaults()
+	config.Privacy.UserLinkKey = "test link key"
+
+	const id = "0123456789abcdef"
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	tests := []struct {
+		name  string
+		query string
+		ok    bool
+		kind  errorKind
+	}{
+		{"signed", "sig=" + userLinkSignature(id, ""), true, 0},
+		{"signed in upper case", "sig=" + strings.ToUpper(userLinkSignature(id, "")), true, 0},
+		{"missing sig", "", false, errForbidden},
+		{"empty sig", "sig=", false, errForbidden},
+		{"tampered sig", "sig=" + userLinkSignature(id, "")[1:] + "0", false, errForbidden},
+		{"another user's sig", "sig=" + userLinkSignature("fedcba9876543210", ""), false, errForbidden},
+		{"not expired", "expires=" + future + "&sig=" + userLinkSignature(id, future), true, 0},
+		{"expired", "expires=" + past + "&sig=" + userLinkSignature(id, past), false, errForbidden},
+		{"expiry changed", "expires=" + future + "&sig=" + userLinkSignature(id, past), false, errForbidden},
+		{"expiry removed", "sig=" + userLinkSignature(id, future), false, errForbidden},
+		{"bad expiry", "expires=soon&sig=" + userLinkSignature(id, "soon"), false, errBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/user/"+id+"?"+test.query, nil)
+			err := checkUserLink(c, id)
+			if test.ok {
+				if err != nil {
+					t.Errorf("got %v, want no error", err)
+				}
+			} else if err == nil || kindOf(err) != test.kind {
+				t.Errorf("got %v, want an error of kind %d", err, test.kind)
+			}
+		})
+	}
+}
+
+func TestCheckUserLinkUnsigned(t *testing.T) {
+	config = &Config{}
+	config.ensureDefaults()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/user/0123456789abcdef", nil)
+	if err := checkUserLink(c, "0123456789abcdef"); err != nil {
+		t.Errorf("got %v, want no error when links aren't signed", err)
+	}
+}
+
+func TestUserLink(t *testing.T) {
+	config = &Config{}
+	config.ensureDefaults()
+	if link := userLink("0123456789abcdef"); link != "user/0123456789abcdef" {
+		t.Errorf("got %q for an unsigned link", link)
+	}
+
+	config.Privacy.UserLinkKey = "test link key"
+	link := userLink("0123456789abcdef")
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/"+link, nil)
+	if err := checkUserLink(c, "0123456789abcdef"); err != nil {
+		t.Errorf("the viewer's own link %q was rejected: %v", link, err)
+	}
+}
@@ -0,0 +1,89 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// the key pseudonyms are made with, in the data directory. Anyone with it could work out which
+// session has which pseudonym.
+const pseudonymKeyFile = "pseudonym.key"
+
+// what players who opted out of showing their history are called instead
+const anonymousPlayer = "Anonymous"
+
+var pseudonymKey []byte
+
+// Pseudonyms are an adjective and an animal. There are 10,000 of them, so two players in the same
+// game will rarely have the same one.
+var pseudonymAdjectives = []string{
+	"Amber", "Aqua", "Azure", "Beige", "Blue", "Blush", "Bronze", "Brown", "Burgundy", "Cerise",
+	"Charcoal", "Cherry", "Chestnut", "Cobalt", "Copper", "Coral", "Cream", "Crimson", "Cyan", "Denim",
+	"Ebony", "Emerald", "Fawn", "Fuchsia", "Ginger", "Gold", "Golden", "Granite", "Green", "Grey",
+	"Hazel", "Honey", "Indigo", "Ivory", "Jade", "Khaki", "Lavender", "Lemon", "Lilac", "Lime",
+	"Magenta", "Mahogany", "Maroon", "Mauve", "Mint", "Misty", "Mustard", "Navy", "Ochre", "Olive",
+	"Onyx", "Orange", "Orchid", "Peach", "Pearl", "Periwinkle", "Pewter", "Pink", "Plum", "Purple",
+	"Quartz", "Raspberry", "Red", "Rose", "Ruby", "Rust", "Saffron", "Sage", "Salmon", "Sapphire",
+	"Scarlet", "Sepia", "Silver", "Slate", "Sunny", "Tan", "Tangerine", "Taupe", "Teal", "Topaz",
+	"Turquoise", "Ultramarine", "Umber", "Vanilla", "Vermilion", "Violet", "Viridian", "Walnut", "Wheat", "Wine",
+	"Brave", "Bouncy", "Clever", "Dapper", "Fuzzy", "Jolly", "Mellow", "Nimble", "Sleepy", "Witty",
+}
+
+var pseudonymAnimals = []string{
+	"Aardvark", "Albatross", "Alligator", "Alpaca", "Anteater", "Antelope", "Armadillo", "Badger", "Bat", "Beaver",
+	"Bison", "Boar", "Buffalo", "Camel", "Caribou", "Cat", "Chameleon", "Cheetah", "Chinchilla", "Chipmunk",
+	"Cobra", "Cougar", "Coyote", "Crab", "Crane", "Crocodile", "Crow", "Deer", "Dingo", "Dolphin",
+	"Donkey", "Dove", "Dragonfly", "Duck", "Eagle", "Echidna", "Eel", "Elephant", "Elk", "Emu",
+	"Falcon", "Ferret", "Flamingo", "Fox", "Frog", "Gazelle", "Gecko", "Gerbil", "Giraffe", "Goat",
+	"Goose", "Gorilla", "Hamster", "Hare", "Hedgehog", "Heron", "Hippo", "Hyena", "Ibis", "Iguana",
+	"Jackal", "Jaguar", "Jellyfish", "Kangaroo", "Kiwi", "Koala", "Lemur", "Leopard", "Llama", "Lobster",
+	"Lynx", "Macaw", "Manatee", "Meerkat", "Mole", "Mongoose", "Moose", "Narwhal", "Newt", "Ocelot",
+	"Octopus", "Otter", "Owl", "Panda", "Pangolin", "Panther", "Parrot", "Pelican", "Penguin", "Puffin",
+	"Quokka", "Raccoon", "Raven", "Salamander", "Seal", "Sloth", "Tapir", "Toucan", "Walrus", "Wombat",
+}
+
+// pseudonym is a friendly name for a session, which is always the same for the same session but
+// doesn't give away its ID.
+func pseudonym(sessionId string) string {
+	mac := hmac.New(sha256.New, pseudonymKey)
+	mac.Write([]byte(sessionId))
+	sum := mac.Sum(nil)
+	adjective := binary.BigEndian.Uint32(sum[0:4]) % uint32(len(pseudonymAdjectives))
+	animal := binary.BigEndian.Uint32(sum[4:8]) % uint32(len(pseudonymAnimals))
+	return pseudonymAdjectives[adjective] + " " + pseudonymAnimals[animal]
+}
+
+// playerName is what a session is called next to its plays, judged rounds, and scores.
+func playerName(sessionId string) string {
+	if sessionId == "" {
+		return ""
+	}
+	if sessionOptedOut(sessionId) {
+		return anonymousPlayer
+	}
+	return pseudonym(sessionId)
+}
@@ -0,0 +1,400 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"github.com/gin-gonic/gin"
+)
+
+// how many cards to show on a leaderboard
+const ratingsLeaderboardSize = 100
+
+// the rating every card starts at
+const initialRating = 1500
+
+var getRatingRoundsStmt *sql.Stmt
+
+type ratingsHandler struct{}
+
+// ratingState is everything that's needed to carry on rating rounds where we left off, and is what
+// gets saved to disk between runs.
+type ratingState struct {
+	// LastRoundUid is the round_complete uid of the last round that has been rated.
+	LastRoundUid int64
+	RatedRounds  int64
+	// KFactor is what the ratings were worked out with. If it changes, they're worked out again.
+	KFactor   float64
+	UpdatedAt time.Time
+	Cards     map[int64]*model.CardRating
+}
+
+var ratings = struct {
+	sync.RWMutex
+	state ratingState
+	// every card that's been in enough rounds, best first
+	ranked []model.CardRating
+}{
+	state: newRatingState(),
+}
+
+func init() {
+	log.Debug("Registering ratings handler")
+	registerHandler(ratingsHandler{})
+}
+
+func newRatingState() ratingState {
+	return ratingState{Cards: map[int64]*model.CardRating{}}
+}
+
+func (ratingsHandler) prepareStatements(db *sql.DB) error {
+	var err error
+	// Every white card played in the next $2 rounds after round_complete uid $1, with the cards in
+	// each play in the order they were played. Rounds without any cards still get a row so that
+	// they get counted.
+	getRatingRoundsStmt, err = db.Prepare("SELECT rc.uid, jt.session_id, " +
+		"COALESCE(jt.session_id = rc.winner_session_id, false), wc.uid, wc.watermark " +
+		"FROM round_complete rc " +
+		"LEFT JOIN round_complete__user_session__white_card jt ON jt.round_complete_uid = rc.uid " +
+		"LEFT JOIN white_card wc ON wc.uid = jt.white_card_uid " +
+		"WHERE rc.uid IN (SELECT uid FROM round_complete WHERE uid > $1 ORDER BY uid LIMIT $2) " +
+		"ORDER BY rc.uid, jt.session_id, jt.white_card_index")
+	return err
+}
+
+func (ratingsHandler) registerEndpoints(r *gin.Engine) {
+	log.Debug("Registering endpoint for ratings handler")
+	r.GET("/ratings", getRatings)
+}
+
+func (ratingsHandler) runInBackground() {
+	loadRatings()
+	interval := time.Duration(config.Ratings.UpdateInterval) * time.Second
+	for {
+		updateRatings()
+		time.Sleep(interval)
+	}
+}
+
+func ratingsPath() string {
+	return filepath.Join(config.DataDir, "ratings.gob")
+}
+
+// loadRatings picks up the ratings from the last run, if there are any that are still usable.
+func loadRatings() {
+	f, err := os.Open(ratingsPath())
+	if os.IsNotExist(err) {
+		log.Infof("No saved card ratings, rating every round from the start.")
+		return
+	} else if err != nil {
+		log.Errorf("Unable to open saved card ratings: %v", err)
+		return
+	}
+	defer f.Close()
+
+	state := newRatingState()
+	if err = gob.NewDecoder(f).Decode(&state); err != nil {
+		log.Errorf("Unable to read saved card ratings, rating every round from the start: %v", err)
+		return
+	}
+	if state.KFactor != config.Ratings.KFactor {
+		log.Infof("K-factor changed from %v to %v, rating every round from the start.", state.KFactor,
+			config.Ratings.KFactor)
+		return
+	}
+	ratings.Lock()
+	ratings.state = state
+	ratings.ranked = rankRatings(state.Cards)
+	ratings.Unlock()
+	log.Infof("Loaded ratings for %d cards from %d rounds.", len(state.Cards), state.RatedRounds)
+}
+
+// saveRatings writes the ratings out so the next run doesn't have to start over.
+func saveRatings(state *ratingState) error {
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		return err
+	}
+	tmp := ratingsPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(f).Encode(state); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ratingsPath())
+}
+
+// updateRatings rates every round that has finished since the last time, a batch at a time.
+func updateRatings() {
+	// The only writer is the background goroutine, so it's safe to work on a copy outside of the
+	// lock and swap it in when each batch is done.
+	ratings.RLock()
+	state := copyRatingState(&ratings.state)
+	ratings.RUnlock()
+	state.KFactor = config.Ratings.KFactor
+
+	rated := int64(0)
+	for {
+		count, err := rateNextRounds(&state)
+		if err != nil {
+			log.Errorf("Unable to update card ratings: %v", err)
+			break
+		}
+		rated += int64(count)
+		if count == 0 {
+			break
+		}
+		state.UpdatedAt = time.Now()
+		ranked := rankRatings(state.Cards)
+		ratings.Lock()
+		ratings.state = copyRatingState(&state)
+		ratings.ranked = ranked
+		ratings.Unlock()
+		if count < config.Ratings.BatchSize {
+			break
+		}
+	}
+
+	if rated > 0 {
+		log.Infof("Rated %d new rounds.", rated)
+		if err := saveRatings(&state); err != nil {
+			log.Errorf("Unable to save card ratings: %v", err)
+		}
+	}
+}
+
+func copyRatingState(state *ratingState) ratingState {
+	out := *state
+	out.Cards = make(map[int64]*model.CardRating, len(state.Cards))
+	for uid, card := range state.Cards {
+		copied := *card
+		out.Cards[uid] = &copied
+	}
+	return out
+}
+
+type ratedPlay struct {
+	won   bool
+	cards []int64
+}
+
+// rateNextRounds rates the next batch of rounds, and returns how many there were.
+func rateNextRounds(state *ratingState) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout())
+	defer cancel()
+	q, err := getRatingRoundsStmt.QueryContext(ctx, state.LastRoundUid, config.Ratings.BatchSize)
+	if err != nil {
+		return 0, dbError(err, "Unable to query for rounds to rate.")
+	}
+	defer q.Close()
+
+	count := 0
+	roundUid := int64(-1)
+	lastSession := ""
+	var plays []*ratedPlay
+	for q.Next() {
+		var uid int64
+		var cardUid sql.NullInt64
+		var sessionId, watermark sql.NullString
+		var won bool
+		if err = q.Scan(&uid, &sessionId, &won, &cardUid, &watermark); err != nil {
+			return 0, dbError(err, "Unable to read rounds to rate.")
+		}
+		if uid != roundUid {
+			rateRound(state, plays)
+			count++
+			roundUid = uid
+			lastSession = ""
+			plays = nil
+		}
+		if !cardUid.Valid {
+			continue
+		}
+		if sessionId.String != lastSession || len(plays) == 0 {
+			plays = append(plays, &ratedPlay{won: won})
+			lastSession = sessionId.String
+		}
+		play := plays[len(plays)-1]
+		play.cards = append(play.cards, cardUid.Int64)
+		if _, ok := state.Cards[cardUid.Int64]; !ok {
+			state.Cards[cardUid.Int64] = &model.CardRating{UID: cardUid.Int64, Watermark: watermark.String,
+				Rating: initialRating}
+		}
+	}
+	if q.Err() != nil {
+		return 0, dbError(q.Err(), "Unable to read rounds to rate.")
+	}
+	rateRound(state, plays)
+	if count > 0 {
+		state.LastRoundUid = roundUid
+		state.RatedRounds += int64(count)
+	}
+	return count, nil
+}
+
+// rateRound treats the round as a contest between the winning play and each of the other plays,
+// and moves the ratings of every card in them by the same amount as the play they were in.
+func rateRound(state *ratingState, plays []*ratedPlay) {
+	var winner *ratedPlay
+	for _, play := range plays {
+		for _, uid := range play.cards {
+			state.Cards[uid].Rounds++
+			if play.won {
+				state.Cards[uid].Wins++
+			}
+		}
+		if play.won {
+			winner = play
+		}
+	}
+	if winner == nil || len(plays) < 2 {
+		return
+	}
+
+	// Split the K-factor across every matchup so that big rounds don't move ratings any more than
+	// small ones do.
+	k := state.KFactor / float64(len(plays)-1)
+	winnerRating := playRating(state, winner)
+	winnerDelta := 0.0
+	for _, play := range plays {
+		if play == winner {
+			continue
+		}
+		expected := 1 / (1 + math.Pow(10, (playRating(state, play)-winnerRating)/400))
+		delta := k * (1 - expected)
+		winnerDelta += delta
+		for _, uid := range play.cards {
+			state.Cards[uid].Rating -= delta
+		}
+	}
+	for _, uid := range winner.cards {
+		state.Cards[uid].Rating += winnerDelta
+	}
+}
+
+// playRating is the average rating of the cards in a play.
+func playRating(state *ratingState, play *ratedPlay) float64 {
+	total := 0.0
+	for _, uid := range play.cards {
+		total += state.Cards[uid].Rating
+	}
+	return total / float64(len(play.cards))
+}
+
+func rankRatings(cards map[int64]*model.CardRating) []model.CardRating {
+	ranked := []model.CardRating{}
+	for _, card := range cards {
+		if card.Rounds >= config.Ratings.MinRounds {
+			ranked = append(ranked, *card)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Rating != ranked[j].Rating {
+			return ranked[i].Rating > ranked[j].Rating
+		}
+		return ranked[i].UID < ranked[j].UID
+	})
+	return ranked
+}
+
+func getRatings(c *gin.Context) {
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	leaderboard, err := loadLeaderboard(ctx, c.Query("watermark"))
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(200, "ratings", &leaderboard)
+	} else {
+		c.JSON(200, leaderboard)
+	}
+}
+
+// loadLeaderboard gets the best rated cards, either overall or for one watermark.
+func loadLeaderboard(ctx context.Context, watermark string) (model.Leaderboard, error) {
+	leaderboard := model.Leaderboard{
+		Watermark:  watermark,
+		MinRounds:  config.Ratings.MinRounds,
+		Watermarks: []string{},
+		Cards:      []model.RatedCard{},
+	}
+	top := []model.CardRating{}
+	watermarks := map[string]bool{}
+
+	ratings.RLock()
+	leaderboard.RatedRounds = ratings.state.RatedRounds
+	leaderboard.UpdatedAt = ratings.state.UpdatedAt
+	for _, card := range ratings.ranked {
+		if !watermarks[card.Watermark] {
+			watermarks[card.Watermark] = true
+			leaderboard.Watermarks = append(leaderboard.Watermarks, card.Watermark)
+		}
+		if len(top) < ratingsLeaderboardSize && (watermark == "" || card.Watermark == watermark) {
+			top = append(top, card)
+		}
+	}
+	ratings.RUnlock()
+	sort.Strings(leaderboard.Watermarks)
+
+	uids := make([]int64, len(top))
+	for i, card := range top {
+		uids[i] = card.UID
+	}
+	cards, err := loadWhiteCardsByUid(ctx, uids)
+	if err != nil {
+		return model.Leaderboard{}, err
+	}
+	for _, rating := range top {
+		card, ok := cards[rating.UID]
+		if !ok {
+			continue
+		}
+		leaderboard.Cards = append(leaderboard.Cards, model.RatedCard{
+			Card:   card,
+			Rating: rating.Rating,
+			Rounds: rating.Rounds,
+			Wins:   rating.Wins,
+		})
+	}
+	return leaderboard, nil
+}
@@ -0,0 +1,311 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"github.com/gin-gonic/gin"
+)
+
+// the reports and the moderators' decisions, in the data directory
+const (
+	reportsFile = "reports.json"
+	auditFile   = "audit.log"
+	reporterKey = "reporter.key"
+)
+
+// the longest the details of a report can be
+const reportDetailsLength = 500
+
+// reportReasons are what someone can report a round or deck for.
+var reportReasons = []string{"Offensive", "Personal information", "Spam", "Other"}
+
+type reportHandler struct{}
+
+var reports = struct {
+	sync.Mutex
+	all    []model.Report
+	nextId int64
+	// recent is when each reporter made their reports in the last hour, for rate limiting
+	recent map[string][]time.Time
+	key    []byte
+}{
+	recent: map[string][]time.Time{},
+}
+
+func init() {
+	log.Debug("Registering report handler")
+	registerHandler(reportHandler{})
+}
+
+func (reportHandler) prepareStatements(*sql.DB) error {
+	key, err := loadOrCreateKey(reporterKey)
+	if err != nil {
+		return err
+	}
+	all := []model.Report{}
+	if err = readJSONFile(reportsFile, &all); err != nil {
+		return err
+	}
+
+	reports.Lock()
+	defer reports.Unlock()
+	reports.key = key
+	reports.all = all
+	reports.nextId = 1
+	for _, report := range all {
+		if report.Id >= reports.nextId {
+			reports.nextId = report.Id + 1
+		}
+	}
+	return nil
+}
+
+func (reportHandler) registerEndpoints(r *gin.Engine) {
+	log.Debug("Registering endpoint for report handler")
+	r.POST("/report", postReport)
+}
+
+func (reportHandler) registerAdminEndpoints(r *gin.RouterGroup) {
+	log.Debug("Registering admin endpoints for report handler")
+	r.GET("/reports", requireRole("moderator"), getReviewQueue)
+	r.POST("/reports/dismiss", requireRole("moderator"), decideReports("dismiss"))
+	r.POST("/reports/hide", requireRole("moderator"), decideReports("hide"))
+}
+
+func postReport(c *gin.Context) {
+	kind := c.PostForm("kind")
+	reason := c.PostForm("reason")
+	details := strings.TrimSpace(c.PostForm("details"))
+	if kind != "round" && kind != "deck" {
+		returnError(c, badRequestError("Only rounds and decks can be reported."))
+		return
+	}
+	id, err := canonicalBlockId(kind, c.PostForm("id"))
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+	if !containsString(reportReasons, reason) {
+		returnError(c, badRequestError("'%s' is not a reason to report something.", reason))
+		return
+	}
+	if len(details) > reportDetailsLength {
+		returnError(c, badRequestError("The details can be at most %d characters long.", reportDetailsLength))
+		return
+	}
+
+	if err = addReport(kind, id, reason, details, reporterAddress(c.Request)); err != nil {
+		returnError(c, err)
+		return
+	}
+	target := model.ReportTarget{Kind: kind, Id: id}
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(http.StatusCreated, "reported", &target)
+	} else {
+		c.JSON(http.StatusCreated, target)
+	}
+}
+
+// reporterAddress is the address a report came from. X-Forwarded-For is only believed when the
+// request came from a configured proxy, and then only its last entry, which that proxy added;
+// anyone else could send a new one with every report.
+func reporterAddress(r *http.Request) string {
+	address, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		address = r.RemoteAddr
+	}
+	for _, proxy := range config.Reports.TrustedProxies {
+		if address != proxy {
+			continue
+		}
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if last := strings.TrimSpace(forwarded[len(forwarded)-1]); last != "" {
+			return last
+		}
+		break
+	}
+	return address
+}
+
+// addReport records a report, unless whoever made it has made too many lately. Reporting the same
+// thing again while the first report is still open does nothing.
+func addReport(kind string, id string, reason string, details string, address string) error {
+	reports.Lock()
+	defer reports.Unlock()
+
+	mac := hmac.New(sha256.New, reports.key)
+	mac.Write([]byte(address))
+	reporter := hex.EncodeToString(mac.Sum(nil))[:16]
+
+	now := time.Now()
+	for other, times := range reports.recent {
+		if now.Sub(times[len(times)-1]) >= time.Hour {
+			delete(reports.recent, other)
+		}
+	}
+	recent := []time.Time{}
+	for _, t := range reports.recent[reporter] {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= config.Reports.PerHour {
+		reports.recent[reporter] = recent
+		return newError(errRateLimited, "You have made too many reports. Try again later.")
+	}
+	reports.recent[reporter] = append(recent, now)
+
+	for _, report := range reports.all {
+		if report.Status == "open" && report.Kind == kind && report.EntityId == id && report.ReporterHash == reporter {
+			return nil
+		}
+	}
+	report := model.Report{
+		Id:           reports.nextId,
+		Kind:         kind,
+		EntityId:     id,
+		Reason:       reason,
+		Details:      details,
+		ReporterHash: reporter,
+		Created:      now,
+		Status:       "open",
+	}
+	all := append(reports.all[:len(reports.all):len(reports.all)], report)
+	if err := writeJSONFile(reportsFile, all); err != nil {
+		return &viewerError{kind: errInternal, detail: "Unable to save the report.", cause: err}
+	}
+	reports.all = all
+	reports.nextId++
+	log.Infof("%s %s reported for %s.", kind, id, reason)
+	return nil
+}
+
+func getReviewQueue(c *gin.Context) {
+	queue := loadReviewQueue()
+	queue.Admin = adminSession(c)
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(http.StatusOK, "reports", &queue)
+	} else {
+		c.JSON(http.StatusOK, queue)
+	}
+}
+
+// loadReviewQueue collects the open reports about each round or deck.
+func loadReviewQueue() model.ReviewQueue {
+	reports.Lock()
+	defer reports.Unlock()
+	queue := model.ReviewQueue{Items: []model.ReportedItem{}}
+	index := map[string]int{}
+	for _, report := range reports.all {
+		if report.Status != "open" {
+			continue
+		}
+		key := blockKey(report.Kind, report.EntityId)
+		i, ok := index[key]
+		if !ok {
+			i = len(queue.Items)
+			index[key] = i
+			queue.Items = append(queue.Items, model.ReportedItem{Kind: report.Kind, Id: report.EntityId})
+		}
+		queue.Items[i].Reports = append(queue.Items[i].Reports, report)
+	}
+	return queue
+}
+
+// decideReports closes every open report about a round or deck, either dismissing them or hiding
+// it by adding it to the blocklist.
+func decideReports(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		kind := c.PostForm("kind")
+		id := c.PostForm("id")
+		if kind != "round" && kind != "deck" {
+			returnError(c, badRequestError("Only rounds and decks can be reported."))
+			return
+		}
+
+		reports.Lock()
+		defer reports.Unlock()
+		all := make([]model.Report, len(reports.all))
+		copy(all, reports.all)
+		reasons := []string{}
+		decided := []model.Report{}
+		now := time.Now()
+		status := map[string]string{"dismiss": "dismissed", "hide": "hidden"}[action]
+		for i := range all {
+			report := &all[i]
+			if report.Status != "open" || report.Kind != kind || report.EntityId != id {
+				continue
+			}
+			if !containsString(reasons, report.Reason) {
+				reasons = append(reasons, report.Reason)
+			}
+			report.Status = status
+			report.DecidedAt = now
+			decided = append(decided, *report)
+		}
+		if len(decided) == 0 {
+			returnError(c, notFoundError("There are no open reports about %s %s.", kind, id))
+			return
+		}
+
+		reason := "Reported: " + strings.Join(reasons, ", ")
+		if action == "hide" {
+			if _, err := addBlock(kind, id, reason); err != nil {
+				returnError(c, err)
+				return
+			}
+		}
+		if err := writeJSONFile(reportsFile, all); err != nil {
+			returnError(c, &viewerError{kind: errInternal, detail: "Unable to save the reports.", cause: err})
+			return
+		}
+		reports.all = all
+		recordAudit(adminSession(c).User, action, kind, id, reason)
+
+		if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+			c.Redirect(http.StatusSeeOther, "/admin/reports")
+		} else {
+			c.JSON(http.StatusOK, decided)
+		}
+	}
+}
+
+// recordAudit adds a decision made by an admin user, or from the command line, to the audit log.
+func recordAudit(admin string, action string, kind string, id string, reason string) {
+	entry := model.AuditEntry{Time: time.Now(), Admin: admin, Action: action, Kind: kind, Id: id, Reason: reason}
+	if err := appendJSONLine(auditFile, entry); err != nil {
+		log.Errorf("Unable to record %s of %s %s in the audit log: %v", action, kind, id, err)
+	}
+}
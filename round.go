@@ -24,8 +24,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"github.com/ajanata/pyx-metrics-viewer/model"
 	"github.com/gin-gonic/gin"
 	"strings"
 	"time"
@@ -34,33 +35,8 @@ import (
 var getRoundWhiteCards *sql.Stmt
 var getRoundInfo *sql.Stmt
 
-type CardMeta struct {
-	Color string
-	Draw  int16 `json:",omitempty"`
-	Pick  int16 `json:",omitempty"`
-}
-
-type Card struct {
-	Text      string
-	Watermark string
-	Meta      CardMeta
-}
-
-type Round struct {
-	GameId      string
-	BlackCard   Card
-	WinningPlay []Card
-	OtherPlays  [][]Card
-	Timestamp   int64
-}
-
 type roundHandler struct{}
 
-func (round *Round) FormattedTimestamp() string {
-	//	return time.Unix(round.Timestamp, 0).UTC().Format("Mon, 02 Jan 2006 15:04:05") + " PDT -0700"
-	return time.Unix(round.Timestamp, 0).UTC().Format(time.RFC1123)
-}
-
 func init() {
 	log.Debug("Registering round handler")
 	registerHandler(roundHandler{})
@@ -75,7 +51,7 @@ func (h roundHandler) prepareStatements(db *sql.DB) error {
 	log.Debug("Preparing statements for round handler")
 	var err error
 	getRoundWhiteCards, err = db.Prepare(
-		"SELECT jt.white_card_index, wc.text, wc.watermark, (rc.winner_session_id = jt.session_id) " +
+		"SELECT jt.session_id, jt.white_card_index, wc.uid, wc.text, wc.watermark, (rc.winner_session_id = jt.session_id) " +
 			"FROM round_complete rc " +
 			"JOIN round_complete__user_session__white_card jt ON jt.round_complete_uid = rc.uid " +
 			"JOIN white_card wc ON wc.uid = jt.white_card_uid " +
@@ -84,7 +60,7 @@ func (h roundHandler) prepareStatements(db *sql.DB) error {
 	if err != nil {
 		return err
 	}
-	getRoundInfo, err = db.Prepare("SELECT bc.text, bc.watermark, bc.pick, bc.draw, rc.game_id, ((rc.meta).timestamp AT TIME ZONE 'UTC') " +
+	getRoundInfo, err = db.Prepare("SELECT bc.uid, bc.text, bc.watermark, bc.pick, bc.draw, rc.game_id, rc.judge_session_id, ((rc.meta).timestamp AT TIME ZONE 'UTC') " +
 		"FROM round_complete rc " +
 		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
 		"WHERE rc.round_id = $1")
@@ -92,103 +68,110 @@ func (h roundHandler) prepareStatements(db *sql.DB) error {
 }
 
 func getRound(c *gin.Context) {
-	info, err := getRoundInfo.Query(c.Param("id"))
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	round, err := loadRound(ctx, c.Param("id"))
 	if err != nil {
-		returnError(c, 500, fmt.Sprintf("Unable to query for round id %s: %v", c.Param("id"), err))
+		returnError(c, err)
 		return
 	}
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(200, "round", &round)
+	} else {
+		c.JSON(200, round)
+	}
+}
+
+func loadRound(ctx context.Context, id string) (model.Round, error) {
+	if err := validateId("round", id); err != nil {
+		return model.Round{}, err
+	}
+	if err := checkBlocked("round", id); err != nil {
+		return model.Round{}, err
+	}
+	info, err := getRoundInfo.QueryContext(ctx, id)
+	if err != nil {
+		return model.Round{}, dbError(err, "Unable to query for round id %s.", id)
+	}
 	defer info.Close()
+	var blackUid int64
 	var blackText string
 	var blackWatermark string
 	var pick int16
 	var draw int16
 	var gameId string
+	var judgeSessionId string
 	var timestamp time.Time
 	if !info.Next() {
-		returnError(c, 404, "That round cannot be found. If you just played it, wait a few seconds and try again.")
-		return
+		if info.Err() != nil {
+			return model.Round{}, dbError(info.Err(), "Unable to query for round id %s.", id)
+		}
+		return model.Round{}, notFoundError("That round cannot be found. If you just played it, wait a few seconds and try again.")
+	}
+	err = info.Scan(&blackUid, &blackText, &blackWatermark, &pick, &draw, &gameId, &judgeSessionId, &timestamp)
+	if err != nil {
+		return model.Round{}, dbError(err, "Unable to read round id %s.", id)
 	}
-	info.Scan(&blackText, &blackWatermark, &pick, &draw, &gameId, &timestamp)
-	round := Round{
-		BlackCard: Card{
+	if err = checkBlocked("game", gameId); err != nil {
+		return model.Round{}, err
+	}
+	round := model.Round{
+		BlackCard: model.Card{
+			UID:       blackUid,
 			Text:      blackText,
 			Watermark: blackWatermark,
-			Meta: CardMeta{
+			Meta: model.CardMeta{
 				Color: "black",
 				Draw:  draw,
 				Pick:  pick,
 			},
 		},
-		GameId:    gameId,
-		Timestamp: timestamp.Unix(),
+		GameId:         gameId,
+		Timestamp:      timestamp.Unix(),
+		RoundId:        id,
+		JudgeSessionId: judgeSessionId,
+		Judge:          playerName(judgeSessionId),
 	}
+	filterCard(ctx, &round.BlackCard)
 	info.Close()
 
-	rows, err := getRoundWhiteCards.Query(c.Param("id"))
+	rows, err := getRoundWhiteCards.QueryContext(ctx, id)
 	if err != nil {
-		returnError(c, 500, fmt.Sprintf("Unable to query for id %s: %v", c.Param("id"), err))
-		return
+		return model.Round{}, dbError(err, "Unable to query for cards in round id %s.", id)
 	}
 	defer rows.Close()
 
-	temp := []Card{}
-	lastWasWinner := false
 	for rows.Next() {
+		var sessionId string
 		var whiteIndex int
+		var whiteUid int64
 		var whiteText string
 		var whiteWatermark string
 		var winner bool
-		rows.Scan(&whiteIndex, &whiteText, &whiteWatermark, &winner)
-		whiteText = filterWhiteCardText(whiteText)
-		if whiteIndex == 0 {
+		rows.Scan(&sessionId, &whiteIndex, &whiteUid, &whiteText, &whiteWatermark, &winner)
+		card := model.Card{
+			UID:       whiteUid,
+			Text:      whiteText,
+			Watermark: whiteWatermark,
+			Meta:      model.CardMeta{Color: "white"},
+		}
+		filterCard(ctx, &card)
+		if len(round.Plays) == 0 || round.Plays[len(round.Plays)-1].SessionId != sessionId {
 			// we're at the start of a new play
-			if len(temp) > 0 {
-				if lastWasWinner {
-					round.WinningPlay = temp
-				} else {
-					round.OtherPlays = append(round.OtherPlays, temp)
-				}
-			}
-			temp = []Card{Card{
-				Text:      whiteText,
-				Watermark: whiteWatermark,
-				Meta:      CardMeta{Color: "white"},
-			}}
-		} else {
-			// we're in the middle of a play
-			temp = append(temp, Card{
-				Text:      whiteText,
-				Watermark: whiteWatermark,
-				Meta:      CardMeta{Color: "white"},
-			})
+			round.Plays = append(round.Plays, model.Play{SessionId: sessionId, Player: playerName(sessionId), Winner: winner})
 		}
-		lastWasWinner = winner
+		play := &round.Plays[len(round.Plays)-1]
+		play.Cards = append(play.Cards, card)
 	}
-	// deal with the last (set of) card(s)
-	if len(temp) > 0 {
-		if lastWasWinner {
-			round.WinningPlay = temp
+	for _, play := range round.Plays {
+		if play.Winner {
+			round.WinningPlay = play.Cards
 		} else {
-			round.OtherPlays = append(round.OtherPlays, temp)
+			round.OtherPlays = append(round.OtherPlays, play.Cards)
 		}
 	}
 	if rows.Err() != nil {
-		log.Errorf("Error while iterating over cards for round %s: %+v", c.Param("id"), rows.Err())
-	}
-	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
-		c.HTML(200, "round", &round)
-	} else {
-		c.JSON(200, round)
-	}
-}
-
-func filterWhiteCardText(text string) string {
-	lower := strings.ToLower(text)
-	for _, str := range config.FilteredText {
-		if strings.Contains(lower, str) {
-			log.Infof("Filtering card text for matching '%s': '%s'", str, text)
-			return "(This card contains a URL and has been filtered.)"
-		}
+		return model.Round{}, dbError(rows.Err(), "Unable to read cards in round id %s.", id)
 	}
-	return text
+	return round, nil
 }
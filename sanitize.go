@@ -0,0 +1,163 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Card text is written by whoever made the deck, and is meant to be HTML, so it can't just be
+// escaped. It's cut down to the markup that cards actually use, and everything else is removed.
+
+// allowedTags are the elements that can be in card text. None of them can have attributes.
+var allowedTags = map[string]bool{
+	"b":      true,
+	"br":     true,
+	"em":     true,
+	"i":      true,
+	"strong": true,
+	"sub":    true,
+	"sup":    true,
+	"u":      true,
+}
+
+// droppedTags are elements whose content goes too, since it's never meant to be seen.
+var droppedTags = map[string]bool{
+	"script": true,
+	"style":  true,
+}
+
+var (
+	tagPattern    = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9]*)\b[^>]*>`)
+	markupPattern = regexp.MustCompile(`^<(?:!--[\s\S]*?-->|[!?/][^>]*>)`)
+	entityPattern = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[a-zA-Z][a-zA-Z0-9]{1,31});`)
+)
+
+// sanitizeHtml removes everything from card text but the allowed elements and entities, and makes
+// sure every element it leaves open is closed.
+func sanitizeHtml(text string) string {
+	var b strings.Builder
+	var open []string
+	for i := 0; i < len(text); {
+		rest := text[i:]
+		switch rest[0] {
+		case '<':
+			if m := tagPattern.FindStringSubmatch(rest); m != nil {
+				i += len(m[0])
+				name := strings.ToLower(m[2])
+				closing := m[1] == "/"
+				if droppedTags[name] && !closing {
+					end := strings.Index(strings.ToLower(text[i:]), "</"+name)
+					if end < 0 {
+						i = len(text)
+					} else {
+						i += end
+					}
+					continue
+				}
+				if !allowedTags[name] {
+					continue
+				}
+				if name == "br" {
+					if !closing {
+						b.WriteString("<br>")
+					}
+				} else if !closing {
+					b.WriteString("<" + name + ">")
+					open = append(open, name)
+				} else {
+					// close the element, and anything opened inside it that wasn't closed
+					for j := len(open) - 1; j >= 0; j-- {
+						if open[j] == name {
+							for k := len(open) - 1; k >= j; k-- {
+								b.WriteString("</" + open[k] + ">")
+							}
+							open = open[:j]
+							break
+						}
+					}
+				}
+				continue
+			}
+			if m := markupPattern.FindString(rest); m != "" {
+				i += len(m)
+				continue
+			}
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '&':
+			if m := entityPattern.FindString(rest); m != "" {
+				b.WriteString(m)
+				i += len(m)
+				continue
+			}
+			b.WriteString("&amp;")
+		case '"':
+			b.WriteString("&#34;")
+		case '\'':
+			b.WriteString("&#39;")
+		default:
+			b.WriteByte(rest[0])
+		}
+		i++
+	}
+	for j := len(open) - 1; j >= 0; j-- {
+		b.WriteString("</" + open[j] + ">")
+	}
+	return b.String()
+}
+
+var brPattern = regexp.MustCompile(`(?i)<br\s*/?>`)
+var anyTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// plainText turns sanitized card text into text without any markup, for places that can't show
+// HTML. Line breaks are kept as newlines.
+func plainText(sanitized string) string {
+	text := brPattern.ReplaceAllString(sanitized, "\n")
+	text = anyTagPattern.ReplaceAllString(text, "")
+	return html.UnescapeString(text)
+}
+
+type textFormatKey struct{}
+
+// withPlainText marks a context as one whose cards should have plain text instead of HTML.
+func withPlainText(ctx context.Context) context.Context {
+	return context.WithValue(ctx, textFormatKey{}, true)
+}
+
+// withHtmlText marks a context as one whose cards should have HTML, even if it was marked for plain
+// text, for loading things that are kept around for other requests.
+func withHtmlText(ctx context.Context) context.Context {
+	return context.WithValue(ctx, textFormatKey{}, false)
+}
+
+// wantsPlainText is whether cards loaded for a context should have plain text instead of HTML.
+func wantsPlainText(ctx context.Context) bool {
+	plain, _ := ctx.Value(textFormatKey{}).(bool)
+	return plain
+}
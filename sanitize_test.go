@@ -0,0 +1,80 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package main
+
+import (
+	"testing"
+)
+
+func TestSanitizeHtml(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain", "Bees?", "Bees?"},
+		{"allowed tags", "<i>Italic</i> and <B>bold</B>", "<i>Italic</i> and <b>bold</b>"},
+		{"line breaks", "one<br/>two<BR>three</br>", "one<br>two<br>three"},
+		{"unclosed", "<b>bold <i>both", "<b>bold <i>both</i></b>"},
+		{"misnested", "<b><i>both</b> after</i>", "<b><i>both</i></b> after"},
+		{"stray close", "text</u>", "text"},
+		{"script", "before<script>alert(1)</script>after", "beforeafter"},
+		{"script without end", "before<SCRIPT>alert(1)", "before"},
+		{"style", "<style>body { display: none }</style>shown", "shown"},
+		{"attributes removed", `<b onclick="alert(1)">x</b>`, "<b>x</b>"},
+		{"disallowed tag", `<img src=x onerror=alert(1)>`, ""},
+		{"javascript url", `<a href="javascript:alert(1)">link</a>`, "link"},
+		{"comment", "a<!-- hidden -->b", "ab"},
+		{"doctype", "<!DOCTYPE html>x", "x"},
+		{"lone brackets", "a < b > c", "a &lt; b &gt; c"},
+		{"not a tag", "<3 you", "&lt;3 you"},
+		{"quotes", `"quoted" 'single'`, "&#34;quoted&#34; &#39;single&#39;"},
+		{"entities kept", "&amp; &copy; &#39; &#x2014;", "&amp; &copy; &#39; &#x2014;"},
+		{"bare ampersand", "Q&A &", "Q&amp;A &amp;"},
+		{"unterminated markup", "<!-- never ends", "&lt;!-- never ends"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := sanitizeHtml(test.text); got != test.want {
+				t.Errorf("sanitizeHtml(%q) = %q, want %q", test.text, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"<i>Italic</i> &amp; plain", "Italic & plain"},
+		{"one<br>two", "one\ntwo"},
+		{"&lt;script&gt;", "<script>"},
+		{"&#34;quoted&#34;", `"quoted"`},
+	}
+	for _, test := range tests {
+		if got := plainText(sanitizeHtml(test.text)); got != test.want {
+			t.Errorf("plainText(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
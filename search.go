@@ -0,0 +1,231 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// how many rounds a search returns
+const searchResults = 50
+
+// the longest search that's allowed
+const maxSearchLength = 200
+
+var searchRoundsStmt *sql.Stmt
+
+// searchMatcher is how one search mode matches a text column against the query in $1. Both are
+// format strings that take the column name.
+type searchMatcher struct {
+	rank  string
+	where string
+}
+
+var searchMatchers = map[string]searchMatcher{
+	"fulltext": {
+		rank:  "ts_rank(to_tsvector('english', %[1]s), plainto_tsquery('english', $1))",
+		where: "to_tsvector('english', %[1]s) @@ plainto_tsquery('english', $1)",
+	},
+	"trigram": {
+		rank:  "similarity(%[1]s, $1)",
+		where: "%[1]s %% $1",
+	},
+	"substring": {
+		rank:  "1.0::real",
+		where: "strpos(lower(%[1]s), lower($1)) > 0",
+	},
+}
+
+type searchHandler struct{}
+
+func init() {
+	log.Debug("Registering search handler")
+	registerHandler(searchHandler{})
+}
+
+func (searchHandler) prepareStatements(db *sql.DB) error {
+	mode := config.Search.Mode
+	if _, ok := searchMatchers[mode]; !ok {
+		return fmt.Errorf("unknown search mode %s", mode)
+	}
+	var err error
+	searchRoundsStmt, err = db.Prepare(searchQuery(searchMatchers[mode]))
+	if err != nil && mode != "substring" {
+		log.Warningf("Unable to use %s search, falling back to substring search: %v", mode, err)
+		searchRoundsStmt, err = db.Prepare(searchQuery(searchMatchers["substring"]))
+	}
+	return err
+}
+
+// searchQuery builds the query to find rounds whose black card or winning white cards match $1.
+// The matching cards are found first, since there are far fewer cards than rounds. $2 and $3 are
+// the start and end of the date range, and $4 is a persistent ID that must have played in or
+// judged the round; any of those can be null. $5 and $6 are the blocked rounds and games.
+func searchQuery(matcher searchMatcher) string {
+	return "WITH black AS (" +
+		"  SELECT uid, " + fmt.Sprintf(matcher.rank, "text") + " rank " +
+		"  FROM black_card WHERE " + fmt.Sprintf(matcher.where, "text") +
+		"), white AS (" +
+		"  SELECT uid, " + fmt.Sprintf(matcher.rank, "text") + " rank " +
+		"  FROM white_card WHERE " + fmt.Sprintf(matcher.where, "text") +
+		"), hits AS (" +
+		"  SELECT rc.uid, b.rank " +
+		"  FROM round_complete rc " +
+		"  JOIN black b ON b.uid = rc.black_card_uid " +
+		"  UNION ALL " +
+		"  SELECT rc.uid, w.rank " +
+		"  FROM round_complete rc " +
+		"  JOIN round_complete__user_session__white_card jt ON jt.round_complete_uid = rc.uid " +
+		"    AND jt.session_id = rc.winner_session_id " +
+		"  JOIN white w ON w.uid = jt.white_card_uid" +
+		") " +
+		"SELECT bc.uid, bc.text, bc.watermark, bc.pick, bc.draw, rc.round_id, " +
+		"  ((rc.meta).timestamp AT TIME ZONE 'UTC') ts, SUM(h.rank) rank " +
+		"FROM hits h " +
+		"JOIN round_complete rc ON rc.uid = h.uid " +
+		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
+		"WHERE NOT (rc.round_id = ANY($5)) AND NOT (rc.game_id = ANY($6)) " +
+		"  AND ($2::timestamptz IS NULL OR ((rc.meta).timestamp AT TIME ZONE 'UTC') >= $2) " +
+		"  AND ($3::timestamptz IS NULL OR ((rc.meta).timestamp AT TIME ZONE 'UTC') < $3) " +
+		"  AND ($4::text IS NULL OR rc.judge_session_id IN (SELECT session_id FROM user_session WHERE persistent_id = $4) " +
+		"    OR EXISTS (SELECT 1 FROM round_complete__user_session__white_card pjt " +
+		"      JOIN user_session us ON us.session_id = pjt.session_id " +
+		"      WHERE pjt.round_complete_uid = rc.uid AND us.persistent_id = $4)) " +
+		"GROUP BY rc.uid, bc.uid, bc.text, bc.watermark, bc.pick, bc.draw, rc.round_id, ts " +
+		"ORDER BY rank DESC, ts DESC " +
+		"LIMIT " + fmt.Sprint(searchResults)
+}
+
+func (searchHandler) registerEndpoints(r *gin.Engine) {
+	log.Debug("Registering endpoint for search handler")
+	r.GET("/search", search)
+}
+
+func search(c *gin.Context) {
+	html := strings.Contains(c.Request.Header.Get("Accept"), "text/html")
+	// just show the form to someone who hasn't searched for anything yet
+	if html && c.Query("q") == "" {
+		c.HTML(200, "search", &model.SearchResults{})
+		return
+	}
+
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	results, err := searchRounds(ctx, c.Query("q"), c.Query("from"), c.Query("to"), c.Query("user"))
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+
+	if html {
+		c.HTML(200, "search", &results)
+	} else {
+		c.JSON(200, results)
+	}
+}
+
+// searchRounds finds rounds by the text on their cards. from and to are inclusive dates, and user
+// is a persistent ID; all of them are optional.
+func searchRounds(ctx context.Context, query string, from string, to string, user string) (model.SearchResults, error) {
+	results := model.SearchResults{
+		Query:        strings.TrimSpace(query),
+		PersistentId: strings.TrimSpace(user),
+		Results:      []model.SearchResult{},
+	}
+	if results.Query == "" {
+		return model.SearchResults{}, badRequestError("Enter some card text to search for.")
+	} else if len(results.Query) > maxSearchLength {
+		return model.SearchResults{}, badRequestError("Searches can be at most %d characters long.", maxSearchLength)
+	}
+
+	var err error
+	if results.From, err = parseSearchDate(from); err != nil {
+		return model.SearchResults{}, err
+	}
+	if results.To, err = parseSearchDate(to); err != nil {
+		return model.SearchResults{}, err
+	}
+	// the end of the range is the end of that day
+	if !results.To.IsZero() {
+		results.To = results.To.Add(24 * time.Hour)
+	}
+	fromParam := sql.NullTime{Time: results.From, Valid: !results.From.IsZero()}
+	toParam := sql.NullTime{Time: results.To, Valid: !results.To.IsZero()}
+	userParam := sql.NullString{String: results.PersistentId, Valid: results.PersistentId != ""}
+	if userParam.Valid {
+		if userLinksSigned() {
+			return model.SearchResults{}, badRequestError("Searching by persistent ID is turned off.")
+		}
+		if err = validateId("persistent", results.PersistentId); err != nil {
+			return model.SearchResults{}, err
+		}
+		if userOptedOut(results.PersistentId) {
+			// not even in aggregate mode, which only ever shows counts
+			return results, nil
+		}
+	}
+
+	q, err := searchRoundsStmt.QueryContext(ctx, results.Query, fromParam, toParam, userParam,
+		pq.Array(blockedIds("round")), pq.Array(blockedIds("game")))
+	if err != nil {
+		return model.SearchResults{}, dbError(err, "Unable to search for rounds.")
+	}
+	defer q.Close()
+	for q.Next() {
+		result := model.SearchResult{Round: model.RoundMeta{BlackCard: model.Card{Meta: model.CardMeta{Color: "black"}}}}
+		card := &result.Round.BlackCard
+		var timestamp time.Time
+		err = q.Scan(&card.UID, &card.Text, &card.Watermark, &card.Meta.Pick, &card.Meta.Draw,
+			&result.Round.RoundId, &timestamp, &result.Rank)
+		if err != nil {
+			return model.SearchResults{}, dbError(err, "Unable to read search results.")
+		}
+		filterCard(ctx, card)
+		result.Round.Timestamp = timestamp.Unix()
+		results.Results = append(results.Results, result)
+	}
+	if q.Err() != nil {
+		return model.SearchResults{}, dbError(q.Err(), "Unable to read search results.")
+	}
+	return results, nil
+}
+
+func parseSearchDate(date string) (time.Time, error) {
+	if date == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return time.Time{}, badRequestError("'%s' is not a date; use YYYY-MM-DD.", date)
+	}
+	return t, nil
+}
@@ -24,9 +24,11 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"github.com/ajanata/pyx-metrics-viewer/model"
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 	"strings"
 	"time"
 )
@@ -37,27 +39,8 @@ var getSessionPlayedRoundsStmt *sql.Stmt
 var getSessionJudgedRoundsStmt *sql.Stmt
 var getSessionRoundCountsStmt *sql.Stmt
 
-type SessionMeta struct {
-	LogInTimestamp int64
-	PersistentId   string
-	Games          []GameMeta
-	PlayedRounds   []RoundMeta
-	JudgedRounds   []RoundMeta
-}
-
-type SessionCounts struct {
-	SessionId        string
-	PlayedRoundCount int
-	JudgedRoundCount int
-}
-
 type sessionHandler struct{}
 
-func (session *SessionMeta) FormattedTimestamp() string {
-	//	return time.Unix(session.LogInTimestamp, 0).UTC().Format("Mon, 02 Jan 2006 15:04:05") + " PDT -0700"
-	return time.Unix(session.LogInTimestamp, 0).UTC().Format(time.RFC1123)
-}
-
 func init() {
 	log.Debug("Registering session handler")
 	registerHandler(sessionHandler{})
@@ -95,20 +78,23 @@ func (h sessionHandler) prepareStatements(db *sql.DB) error {
 		return err
 	}
 
-	getSessionPlayedRoundsStmt, err = db.Prepare("SELECT bc.text, bc.watermark, bc.pick, bc.draw, rc.round_id, ((rc.meta).timestamp AT TIME ZONE 'UTC') " +
+	// These two leave out the rounds in $2 and the games in $3, which are the blocked ones.
+	getSessionPlayedRoundsStmt, err = db.Prepare("SELECT bc.uid, bc.text, bc.watermark, bc.pick, bc.draw, rc.round_id, ((rc.meta).timestamp AT TIME ZONE 'UTC') " +
 		"FROM round_complete__user_session__white_card jt " +
 		"JOIN round_complete rc ON rc.uid = jt.round_complete_uid " +
 		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
 		"WHERE jt.session_id = $1 AND jt.white_card_index = 0 " +
+		"  AND NOT (rc.round_id = ANY($2)) AND NOT (rc.game_id = ANY($3)) " +
 		"ORDER BY ((rc.meta).timestamp) DESC")
 	if err != nil {
 		return err
 	}
 
-	getSessionJudgedRoundsStmt, err = db.Prepare("SELECT bc.text, bc.watermark, bc.pick, bc.draw, rc.round_id, ((rc.meta).timestamp AT TIME ZONE 'UTC') " +
+	getSessionJudgedRoundsStmt, err = db.Prepare("SELECT bc.uid, bc.text, bc.watermark, bc.pick, bc.draw, rc.round_id, ((rc.meta).timestamp AT TIME ZONE 'UTC') " +
 		"FROM round_complete rc " +
 		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
 		"WHERE rc.judge_session_id = $1 " +
+		"  AND NOT (rc.round_id = ANY($2)) AND NOT (rc.game_id = ANY($3)) " +
 		"ORDER BY ((rc.meta).timestamp) DESC")
 	if err != nil {
 		return err
@@ -116,88 +102,128 @@ func (h sessionHandler) prepareStatements(db *sql.DB) error {
 
 	getSessionRoundCountsStmt, err = db.Prepare("SELECT " +
 		"  (SELECT COUNT(*) FROM round_complete WHERE judge_session_id = us.session_id) judged, " +
-		"  (SELECT COUNT(*) FROM round_complete__user_session__white_card WHERE session_id = us.session_id AND white_card_index = 0) played " +
+		"  (SELECT COUNT(*) FROM round_complete__user_session__white_card WHERE session_id = us.session_id AND white_card_index = 0) played, " +
+		"  us.persistent_id " +
 		"FROM user_session us " +
 		"WHERE us.session_id = $1 ")
 	return err
 }
 
 func getSession(c *gin.Context) {
-	q, err := getSessionInfoStmt.Query(c.Param("id"))
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	session, err := loadSession(ctx, c.Param("id"))
 	if err != nil {
-		returnError(c, 500, fmt.Sprintf("Unable to query for session with id %s: %v", c.Param("id"), err))
+		returnError(c, err)
 		return
 	}
+
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(200, "session", &session)
+	} else {
+		c.JSON(200, session)
+	}
+}
+
+func loadSession(ctx context.Context, id string) (model.SessionMeta, error) {
+	if err := validateId("session", id); err != nil {
+		return model.SessionMeta{}, err
+	}
+	q, err := getSessionInfoStmt.QueryContext(ctx, id)
+	if err != nil {
+		return model.SessionMeta{}, dbError(err, "Unable to query for session with id %s.", id)
+	}
 	defer q.Close()
-	session := SessionMeta{}
+	session := model.SessionMeta{}
 	if !q.Next() {
-		msg := "ID not found"
 		if q.Err() != nil {
-			log.Error("While processing result for session %s: %v", c.Param("id"), q.Err())
-			msg = q.Err().Error()
+			return model.SessionMeta{}, dbError(q.Err(), "Unable to query for session with id %s.", id)
 		}
-		returnError(c, 500, fmt.Sprintf("Unable to query for session with id %s: %s", c.Param("id"), msg))
-		return
+		return model.SessionMeta{}, notFoundError("That session cannot be found.")
 	}
 	var timestamp time.Time
-	q.Scan(&timestamp, &session.PersistentId)
+	err = q.Scan(&timestamp, &session.PersistentId)
+	if err != nil {
+		return model.SessionMeta{}, dbError(err, "Unable to read session with id %s.", id)
+	}
+	q.Close()
 	session.LogInTimestamp = timestamp.Unix()
-	session.PlayedRounds, err = getSessionRounds(getSessionPlayedRoundsStmt.Query(c.Param("id")))
+	optedOut := userOptedOut(session.PersistentId)
+	if userLinksSigned() || optedOut {
+		// nothing leads from here to the user's page
+		session.PersistentId = ""
+	}
+	if optedOut {
+		if hideOptedOut() {
+			return model.SessionMeta{}, notFoundError("That session cannot be found.")
+		}
+		counts, err := loadSessionStats(ctx, id)
+		if err != nil {
+			return model.SessionMeta{}, err
+		}
+		session.Hidden = true
+		session.PlayedRoundCount = counts.PlayedRoundCount
+		session.JudgedRoundCount = counts.JudgedRoundCount
+		return session, nil
+	}
+	blockedRounds, blockedGames := pq.Array(blockedIds("round")), pq.Array(blockedIds("game"))
+	session.PlayedRounds, err = getSessionRounds(getSessionPlayedRoundsStmt.QueryContext(ctx, id, blockedRounds,
+		blockedGames))
 	if err != nil {
-		returnError(c, 500, fmt.Sprintf("Unable to query for session with id %s: %v", c.Param("id"), err))
-		return
+		return model.SessionMeta{}, dbError(err, "Unable to query for rounds played by session with id %s.", id)
 	}
-	session.JudgedRounds, err = getSessionRounds(getSessionJudgedRoundsStmt.Query(c.Param("id")))
+	session.JudgedRounds, err = getSessionRounds(getSessionJudgedRoundsStmt.QueryContext(ctx, id, blockedRounds,
+		blockedGames))
 	if err != nil {
-		returnError(c, 500, fmt.Sprintf("Unable to query for session with id %s: %v", c.Param("id"), err))
-		return
+		return model.SessionMeta{}, dbError(err, "Unable to query for rounds judged by session with id %s.", id)
 	}
+	filterRoundCards(ctx, session.PlayedRounds)
+	filterRoundCards(ctx, session.JudgedRounds)
 
-	q, err = getSessionGamesStmt.Query(c.Param("id"))
+	q, err = getSessionGamesStmt.QueryContext(ctx, id)
 	if err != nil {
-		returnError(c, 500, fmt.Sprintf("Unable to query for session with id %s: %v", c.Param("id"), err))
-		return
+		return model.SessionMeta{}, dbError(err, "Unable to query for games of session with id %s.", id)
 	}
 	defer q.Close()
 	for q.Next() {
 		var gameId string
 		var timestamp time.Time
 		q.Scan(&gameId, &timestamp)
-		session.Games = append(session.Games, GameMeta{
+		if isBlocked("game", gameId) {
+			continue
+		}
+		session.Games = append(session.Games, model.GameMeta{
 			GameId:    gameId,
 			Timestamp: timestamp.Unix(),
 		})
 	}
 	if q.Err() != nil {
-		log.Errorf("Error while iterating over games for session %s: %+v", c.Param("id"), q.Err())
-	}
-
-	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
-		c.HTML(200, "session", &session)
-	} else {
-		c.JSON(200, session)
+		return model.SessionMeta{}, dbError(q.Err(), "Unable to read games of session with id %s.", id)
 	}
+	return session, nil
 }
 
-func getSessionRounds(q *sql.Rows, err error) ([]RoundMeta, error) {
-	rounds := []RoundMeta{}
+func getSessionRounds(q *sql.Rows, err error) ([]model.RoundMeta, error) {
+	rounds := []model.RoundMeta{}
 	if err != nil {
 		return rounds, err
 	}
 	defer q.Close()
 	for q.Next() {
+		var uid int64
 		var text string
 		var watermark string
 		var pick int16
 		var draw int16
 		var roundId string
 		var timestamp time.Time
-		q.Scan(&text, &watermark, &pick, &draw, &roundId, &timestamp)
-		rounds = append(rounds, RoundMeta{
-			BlackCard: Card{
+		q.Scan(&uid, &text, &watermark, &pick, &draw, &roundId, &timestamp)
+		rounds = append(rounds, model.RoundMeta{
+			BlackCard: model.Card{
+				UID:       uid,
 				Text:      text,
 				Watermark: watermark,
-				Meta: CardMeta{
+				Meta: model.CardMeta{
 					Color: "black",
 					Draw:  draw,
 					Pick:  pick,
@@ -212,28 +238,43 @@ func getSessionRounds(q *sql.Rows, err error) ([]RoundMeta, error) {
 }
 
 func getSessionStats(c *gin.Context) {
-	q, err := getSessionRoundCountsStmt.Query(c.Param("id"))
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	counts, err := loadSessionStats(ctx, c.Param("id"))
 	if err != nil {
-		returnError(c, 500, fmt.Sprintf("Unable to query stats for session with id %s: %v",
-			c.Param("id"), err))
+		returnError(c, err)
 		return
 	}
+
+	c.JSON(200, counts)
+}
+
+func loadSessionStats(ctx context.Context, id string) (model.SessionCounts, error) {
+	if err := validateId("session", id); err != nil {
+		return model.SessionCounts{}, err
+	}
+	q, err := getSessionRoundCountsStmt.QueryContext(ctx, id)
+	if err != nil {
+		return model.SessionCounts{}, dbError(err, "Unable to query stats for session with id %s.", id)
+	}
 	defer q.Close()
 
-	counts := SessionCounts{
-		SessionId: c.Param("id"),
+	counts := model.SessionCounts{
+		SessionId: id,
 	}
 	if !q.Next() {
-		msg := "ID not found"
 		if q.Err() != nil {
-			log.Error("While processing result for session %s: %v", c.Param("id"), q.Err())
-			msg = q.Err().Error()
+			return model.SessionCounts{}, dbError(q.Err(), "Unable to query stats for session with id %s.", id)
 		}
-		returnError(c, 500, fmt.Sprintf("Unable to query stats for session with id %s: %s",
-			c.Param("id"), msg))
-		return
+		return model.SessionCounts{}, notFoundError("That session cannot be found.")
 	}
-	q.Scan(&counts.JudgedRoundCount, &counts.PlayedRoundCount)
-
-	c.JSON(200, counts)
+	var persistentId string
+	err = q.Scan(&counts.JudgedRoundCount, &counts.PlayedRoundCount, &persistentId)
+	if err != nil {
+		return model.SessionCounts{}, dbError(err, "Unable to read stats for session with id %s.", id)
+	}
+	if hideOptedOut() && userOptedOut(persistentId) {
+		return model.SessionCounts{}, notFoundError("That session cannot be found.")
+	}
+	return counts, nil
 }
@@ -0,0 +1,447 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// how many entries are in each list on the overview page
+const topOverviewSize = 10
+
+// how many entries are on a page for a single list
+const topListSize = 100
+
+// how long to remember the lists. Each one goes over every round in its window, which is too much
+// to do every time someone looks.
+const topCacheTime = 5 * time.Minute
+
+var getTopBlackCardsStmt *sql.Stmt
+var getTopWhiteCardsStmt *sql.Stmt
+var getTopCombinationsStmt *sql.Stmt
+var getTopUsersStmt *sql.Stmt
+var getTopGamesStmt *sql.Stmt
+
+// the lists, in the order they're shown
+var topListNames = []string{"black", "white", "combinations", "users", "games"}
+
+// the windows, in the order they're shown
+var topWindowNames = []string{"day", "week", "month", "all"}
+
+// how far back each window goes
+var topWindows = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"all":   0,
+}
+
+type topHandler struct{}
+
+type topEntry struct {
+	top     model.TopLists
+	expires time.Time
+}
+
+// The lists are cached by window and list. They have already been through the card filter and the
+// blocklist, so the cache is purged whenever those change.
+var topCache = struct {
+	sync.Mutex
+	entries map[string]topEntry
+}{
+	entries: map[string]topEntry{},
+}
+
+func init() {
+	log.Debug("Registering top handler")
+	registerHandler(topHandler{})
+}
+
+// All of these take the start of the window as $1 and how many to return as $2.
+func (topHandler) prepareStatements(db *sql.DB) error {
+	var err error
+	getTopBlackCardsStmt, err = db.Prepare("SELECT bc.uid, bc.text, bc.watermark, bc.pick, bc.draw, COUNT(*) rounds " +
+		"FROM round_complete rc " +
+		"JOIN black_card bc ON bc.uid = rc.black_card_uid " +
+		"WHERE ((rc.meta).timestamp AT TIME ZONE 'UTC') >= $1 " +
+		"GROUP BY bc.uid, bc.text, bc.watermark, bc.pick, bc.draw " +
+		"ORDER BY rounds DESC, bc.uid " +
+		"LIMIT $2")
+	if err != nil {
+		return err
+	}
+	// $3 is how many times a card has to have been played.
+	getTopWhiteCardsStmt, err = db.Prepare("SELECT wc.uid, wc.text, wc.watermark, COUNT(*) plays, " +
+		"  SUM(CASE WHEN jt.session_id = rc.winner_session_id THEN 1 ELSE 0 END) wins " +
+		"FROM round_complete rc " +
+		"JOIN round_complete__user_session__white_card jt ON jt.round_complete_uid = rc.uid " +
+		"JOIN white_card wc ON wc.uid = jt.white_card_uid " +
+		"WHERE ((rc.meta).timestamp AT TIME ZONE 'UTC') >= $1 " +
+		"GROUP BY wc.uid, wc.text, wc.watermark " +
+		"HAVING COUNT(*) >= $3 " +
+		"ORDER BY SUM(CASE WHEN jt.session_id = rc.winner_session_id THEN 1 ELSE 0 END)::float / COUNT(*) DESC, " +
+		"  plays DESC, wc.uid " +
+		"LIMIT $2")
+	if err != nil {
+		return err
+	}
+	getTopCombinationsStmt, err = db.Prepare("WITH wins AS (" +
+		"  SELECT rc.black_card_uid, array_agg(jt.white_card_uid ORDER BY jt.white_card_index) cards " +
+		"  FROM round_complete rc " +
+		"  JOIN round_complete__user_session__white_card jt ON jt.round_complete_uid = rc.uid " +
+		"    AND jt.session_id = rc.winner_session_id " +
+		"  WHERE ((rc.meta).timestamp AT TIME ZONE 'UTC') >= $1 " +
+		"  GROUP BY rc.uid, rc.black_card_uid" +
+		") " +
+		"SELECT bc.uid, bc.text, bc.watermark, bc.pick, bc.draw, w.cards, COUNT(*) wins " +
+		"FROM wins w " +
+		"JOIN black_card bc ON bc.uid = w.black_card_uid " +
+		"GROUP BY bc.uid, bc.text, bc.watermark, bc.pick, bc.draw, w.cards " +
+		"ORDER BY wins DESC, bc.uid " +
+		"LIMIT $2")
+	if err != nil {
+		return err
+	}
+	// $3 is the persistent IDs that are allowed to be listed.
+	getTopUsersStmt, err = db.Prepare("SELECT us.persistent_id, COUNT(*) rounds " +
+		"FROM round_complete__user_session__white_card jt " +
+		"JOIN round_complete rc ON rc.uid = jt.round_complete_uid " +
+		"JOIN user_session us ON us.session_id = jt.session_id " +
+		"WHERE jt.white_card_index = 0 AND ((rc.meta).timestamp AT TIME ZONE 'UTC') >= $1 " +
+		"  AND us.persistent_id = ANY($3) " +
+		"GROUP BY us.persistent_id " +
+		"ORDER BY rounds DESC, us.persistent_id " +
+		"LIMIT $2")
+	if err != nil {
+		return err
+	}
+	// $3 is the blocked games.
+	getTopGamesStmt, err = db.Prepare("SELECT rc.game_id, COUNT(*) rounds " +
+		"FROM round_complete rc " +
+		"WHERE ((rc.meta).timestamp AT TIME ZONE 'UTC') >= $1 " +
+		"  AND NOT (rc.game_id = ANY($3)) " +
+		"GROUP BY rc.game_id " +
+		"ORDER BY rounds DESC, rc.game_id " +
+		"LIMIT $2")
+	return err
+}
+
+func (topHandler) registerEndpoints(r *gin.Engine) {
+	log.Debug("Registering endpoints for top handler")
+	r.GET("/top", getTop)
+	r.GET("/top/:list", getTop)
+}
+
+func getTop(c *gin.Context) {
+	window := c.DefaultQuery("window", "all")
+	if _, ok := topWindows[window]; !ok {
+		window = "all"
+	}
+
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	top, err := loadTop(ctx, window, c.Param("list"))
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(200, "top", &top)
+	} else {
+		c.JSON(200, top)
+	}
+}
+
+// topCacheSize is how many lists are cached.
+func topCacheSize() int {
+	topCache.Lock()
+	defer topCache.Unlock()
+	return len(topCache.entries)
+}
+
+// purgeTopCache forgets every cached list, so that they're queried for again. It returns how many
+// there were.
+func purgeTopCache() int {
+	topCache.Lock()
+	defer topCache.Unlock()
+	purged := len(topCache.entries)
+	topCache.entries = map[string]topEntry{}
+	return purged
+}
+
+// loadTop loads one of the lists, or a few from the top of each of them if list is empty. The lists
+// are cached with HTML card text no matter what was asked for, and only turned into plain text on
+// the way out, so that plain text is never served to a page.
+func loadTop(ctx context.Context, window string, list string) (model.TopLists, error) {
+	key := window + "/" + list
+	topCache.Lock()
+	entry, ok := topCache.entries[key]
+	topCache.Unlock()
+	if !ok || !time.Now().Before(entry.expires) {
+		top, err := queryTop(withHtmlText(ctx), window, list)
+		if err != nil {
+			return model.TopLists{}, err
+		}
+		entry = topEntry{top: top, expires: time.Now().Add(topCacheTime)}
+		topCache.Lock()
+		topCache.entries[key] = entry
+		topCache.Unlock()
+	}
+	if wantsPlainText(ctx) {
+		return plainTopLists(entry.top), nil
+	}
+	return entry.top, nil
+}
+
+// plainTopLists is a copy of cached lists with plain card text, leaving the cached ones alone.
+func plainTopLists(top model.TopLists) model.TopLists {
+	plain := func(card model.Card) model.Card {
+		card.Text = plainText(card.Text)
+		return card
+	}
+	if top.BlackCards != nil {
+		blackCards := make([]model.TopBlackCard, len(top.BlackCards))
+		for i, black := range top.BlackCards {
+			black.Card = plain(black.Card)
+			blackCards[i] = black
+		}
+		top.BlackCards = blackCards
+	}
+	if top.WhiteCards != nil {
+		whiteCards := make([]model.TopWhiteCard, len(top.WhiteCards))
+		for i, white := range top.WhiteCards {
+			white.Card = plain(white.Card)
+			whiteCards[i] = white
+		}
+		top.WhiteCards = whiteCards
+	}
+	if top.Combinations != nil {
+		combinations := make([]model.TopCombination, len(top.Combinations))
+		for i, combination := range top.Combinations {
+			combination.BlackCard = plain(combination.BlackCard)
+			whiteCards := make([]model.Card, len(combination.WhiteCards))
+			for j, white := range combination.WhiteCards {
+				whiteCards[j] = plain(white)
+			}
+			combination.WhiteCards = whiteCards
+			combinations[i] = combination
+		}
+		top.Combinations = combinations
+	}
+	return top
+}
+
+func queryTop(ctx context.Context, window string, list string) (model.TopLists, error) {
+	top := model.TopLists{
+		List:     list,
+		Window:   window,
+		MinPlays: config.Top.MinPlays,
+	}
+	if topWindows[window] > 0 {
+		top.Since = time.Now().UTC().Add(-topWindows[window])
+	}
+	limit := topListSize
+	if list == "" {
+		limit = topOverviewSize
+	}
+
+	var err error
+	switch list {
+	case "":
+		if top.BlackCards, err = loadTopBlackCards(ctx, top.Since, limit); err != nil {
+			return model.TopLists{}, err
+		}
+		if top.WhiteCards, err = loadTopWhiteCards(ctx, top.Since, limit); err != nil {
+			return model.TopLists{}, err
+		}
+		if top.Combinations, err = loadTopCombinations(ctx, top.Since, limit); err != nil {
+			return model.TopLists{}, err
+		}
+		if top.Users, err = loadTopUsers(ctx, top.Since, limit); err != nil {
+			return model.TopLists{}, err
+		}
+		top.Games, err = loadTopGames(ctx, top.Since, limit)
+	case "black":
+		top.BlackCards, err = loadTopBlackCards(ctx, top.Since, limit)
+	case "white":
+		top.WhiteCards, err = loadTopWhiteCards(ctx, top.Since, limit)
+	case "combinations":
+		top.Combinations, err = loadTopCombinations(ctx, top.Since, limit)
+	case "users":
+		top.Users, err = loadTopUsers(ctx, top.Since, limit)
+	case "games":
+		top.Games, err = loadTopGames(ctx, top.Since, limit)
+	default:
+		err = notFoundError("There is no %s list.", list)
+	}
+	if err != nil {
+		return model.TopLists{}, err
+	}
+	return top, nil
+}
+
+func loadTopBlackCards(ctx context.Context, since time.Time, limit int) ([]model.TopBlackCard, error) {
+	q, err := getTopBlackCardsStmt.QueryContext(ctx, since, limit)
+	if err != nil {
+		return nil, dbError(err, "Unable to query for the most played black cards.")
+	}
+	defer q.Close()
+	cards := []model.TopBlackCard{}
+	for q.Next() {
+		card := model.TopBlackCard{Card: model.Card{Meta: model.CardMeta{Color: "black"}}}
+		err = q.Scan(&card.Card.UID, &card.Card.Text, &card.Card.Watermark, &card.Card.Meta.Pick,
+			&card.Card.Meta.Draw, &card.Rounds)
+		if err != nil {
+			return nil, dbError(err, "Unable to read the most played black cards.")
+		}
+		filterCard(ctx, &card.Card)
+		cards = append(cards, card)
+	}
+	if q.Err() != nil {
+		return nil, dbError(q.Err(), "Unable to read the most played black cards.")
+	}
+	return cards, nil
+}
+
+func loadTopWhiteCards(ctx context.Context, since time.Time, limit int) ([]model.TopWhiteCard, error) {
+	q, err := getTopWhiteCardsStmt.QueryContext(ctx, since, limit, config.Top.MinPlays)
+	if err != nil {
+		return nil, dbError(err, "Unable to query for the best white cards.")
+	}
+	defer q.Close()
+	cards := []model.TopWhiteCard{}
+	for q.Next() {
+		card := model.TopWhiteCard{Card: model.Card{Meta: model.CardMeta{Color: "white"}}}
+		err = q.Scan(&card.Card.UID, &card.Card.Text, &card.Card.Watermark, &card.Plays, &card.Wins)
+		if err != nil {
+			return nil, dbError(err, "Unable to read the best white cards.")
+		}
+		filterCard(ctx, &card.Card)
+		cards = append(cards, card)
+	}
+	if q.Err() != nil {
+		return nil, dbError(q.Err(), "Unable to read the best white cards.")
+	}
+	return cards, nil
+}
+
+func loadTopCombinations(ctx context.Context, since time.Time, limit int) ([]model.TopCombination, error) {
+	q, err := getTopCombinationsStmt.QueryContext(ctx, since, limit)
+	if err != nil {
+		return nil, dbError(err, "Unable to query for the most won combinations.")
+	}
+	defer q.Close()
+	combinations := []model.TopCombination{}
+	comboUids := [][]int64{}
+	allUids := []int64{}
+	for q.Next() {
+		var uids []int64
+		combination := model.TopCombination{BlackCard: model.Card{Meta: model.CardMeta{Color: "black"}}}
+		card := &combination.BlackCard
+		err = q.Scan(&card.UID, &card.Text, &card.Watermark, &card.Meta.Pick, &card.Meta.Draw,
+			pq.Array(&uids), &combination.Wins)
+		if err != nil {
+			return nil, dbError(err, "Unable to read the most won combinations.")
+		}
+		filterCard(ctx, card)
+		combinations = append(combinations, combination)
+		comboUids = append(comboUids, uids)
+		allUids = append(allUids, uids...)
+	}
+	if q.Err() != nil {
+		return nil, dbError(q.Err(), "Unable to read the most won combinations.")
+	}
+	q.Close()
+
+	whiteCards, err := loadWhiteCardsByUid(ctx, allUids)
+	if err != nil {
+		return nil, err
+	}
+	for i, uids := range comboUids {
+		for _, uid := range uids {
+			combinations[i].WhiteCards = append(combinations[i].WhiteCards, whiteCards[uid])
+		}
+	}
+	return combinations, nil
+}
+
+func loadTopUsers(ctx context.Context, since time.Time, limit int) ([]model.TopUser, error) {
+	users := []model.TopUser{}
+	// opting out wins over having asked to be listed
+	listed := []string{}
+	for _, id := range config.Top.ListedUsers {
+		if !userOptedOut(id) {
+			listed = append(listed, id)
+		}
+	}
+	// don't bother asking if nobody could be on it
+	if len(listed) == 0 {
+		return users, nil
+	}
+	q, err := getTopUsersStmt.QueryContext(ctx, since, limit, pq.Array(listed))
+	if err != nil {
+		return nil, dbError(err, "Unable to query for the most active users.")
+	}
+	defer q.Close()
+	for q.Next() {
+		user := model.TopUser{}
+		if err = q.Scan(&user.PersistentId, &user.Rounds); err != nil {
+			return nil, dbError(err, "Unable to read the most active users.")
+		}
+		users = append(users, user)
+	}
+	if q.Err() != nil {
+		return nil, dbError(q.Err(), "Unable to read the most active users.")
+	}
+	return users, nil
+}
+
+func loadTopGames(ctx context.Context, since time.Time, limit int) ([]model.TopGame, error) {
+	q, err := getTopGamesStmt.QueryContext(ctx, since, limit, pq.Array(blockedIds("game")))
+	if err != nil {
+		return nil, dbError(err, "Unable to query for the busiest games.")
+	}
+	defer q.Close()
+	games := []model.TopGame{}
+	for q.Next() {
+		game := model.TopGame{}
+		if err = q.Scan(&game.GameId, &game.Rounds); err != nil {
+			return nil, dbError(err, "Unable to read the busiest games.")
+		}
+		games = append(games, game)
+	}
+	if q.Err() != nil {
+		return nil, dbError(q.Err(), "Unable to read the busiest games.")
+	}
+	return games, nil
+}
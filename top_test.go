@@ -0,0 +1,51 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package main
+
+import (
+	"testing"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+)
+
+func TestPlainTopListsLeavesCacheAlone(t *testing.T) {
+	card := model.Card{Text: sanitizeHtml("<img src=x onerror=alert(1)>&lt;b&gt;")}
+	top := model.TopLists{
+		BlackCards:   []model.TopBlackCard{{Card: card}},
+		WhiteCards:   []model.TopWhiteCard{{Card: card}},
+		Combinations: []model.TopCombination{{BlackCard: card, WhiteCards: []model.Card{card}}},
+	}
+	plain := plainTopLists(top)
+	for _, text := range []string{plain.BlackCards[0].Card.Text, plain.WhiteCards[0].Card.Text,
+		plain.Combinations[0].BlackCard.Text, plain.Combinations[0].WhiteCards[0].Text} {
+		if text != "<b>" {
+			t.Errorf("got %q, want plain text", text)
+		}
+	}
+	for _, text := range []string{top.BlackCards[0].Card.Text, top.WhiteCards[0].Card.Text,
+		top.Combinations[0].BlackCard.Text, top.Combinations[0].WhiteCards[0].Text} {
+		if text != "&lt;b&gt;" {
+			t.Errorf("the cached lists were changed to %q", text)
+		}
+	}
+}
@@ -24,35 +24,19 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"github.com/ajanata/pyx-metrics-viewer/model"
 	"github.com/gin-gonic/gin"
 	"strings"
 	"time"
 )
 
 var getUserSessionsStmt *sql.Stmt
-
-type SessionBasics struct {
-	SessionId      string
-	LogInTimestamp int64
-}
-
-type UserMeta struct {
-	Sessions []SessionBasics
-}
+var getUserRoundCountsStmt *sql.Stmt
 
 type userHandler struct{}
 
-func (session *SessionBasics) FormattedTimestamp() string {
-	//	return time.Unix(session.LogInTimestamp, 0).UTC().Format("Mon, 02 Jan 2006 15:04:05") + " PDT -0700"
-	return time.Unix(session.LogInTimestamp, 0).UTC().Format(time.RFC1123)
-}
-
-func (session *SessionBasics) ServerId() string {
-	return strings.Split(session.SessionId, "_")[0]
-}
-
 func init() {
 	log.Debug("Registering user handler")
 	registerHandler(userHandler{})
@@ -70,33 +54,83 @@ func (h userHandler) prepareStatements(db *sql.DB) error {
 		"FROM user_session us " +
 		"WHERE us.persistent_id = $1 " +
 		"ORDER BY (us.meta).timestamp DESC")
+	if err != nil {
+		return err
+	}
+
+	getUserRoundCountsStmt, err = db.Prepare("SELECT COUNT(*), " +
+		"  COALESCE(SUM((SELECT COUNT(*) FROM round_complete WHERE judge_session_id = us.session_id)), 0) judged, " +
+		"  COALESCE(SUM((SELECT COUNT(*) FROM round_complete__user_session__white_card WHERE session_id = us.session_id AND white_card_index = 0)), 0) played " +
+		"FROM user_session us " +
+		"WHERE us.persistent_id = $1")
 	return err
 }
 
 func getUser(c *gin.Context) {
-	q, err := getUserSessionsStmt.Query(c.Param("id"))
+	if err := checkUserLink(c, c.Param("id")); err != nil {
+		returnError(c, err)
+		return
+	}
+	ctx, cancel := queryContext(c)
+	defer cancel()
+	user, err := loadUser(ctx, c.Param("id"))
 	if err != nil {
-		returnError(c, 500, fmt.Sprintf("Unable to query for user with id %s: %v", c.Param("id"), err))
+		returnError(c, err)
 		return
 	}
+	user.ExportLink = exportLink(c, c.Param("id"))
+
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		c.HTML(200, "user", &user)
+	} else {
+		c.JSON(200, user)
+	}
+}
+
+func loadUser(ctx context.Context, id string) (model.UserMeta, error) {
+	if err := validateId("persistent", id); err != nil {
+		return model.UserMeta{}, err
+	}
+	if userOptedOut(id) {
+		if hideOptedOut() {
+			return model.UserMeta{}, notFoundError("No sessions were found for that persistent ID.")
+		}
+		return loadUserCounts(ctx, id)
+	}
+	q, err := getUserSessionsStmt.QueryContext(ctx, id)
+	if err != nil {
+		return model.UserMeta{}, dbError(err, "Unable to query for user with id %s.", id)
+	}
 	defer q.Close()
-	user := UserMeta{}
+	user := model.UserMeta{}
 	for q.Next() {
 		var sessionId string
 		var timestamp time.Time
 		q.Scan(&sessionId, &timestamp)
-		user.Sessions = append(user.Sessions, SessionBasics{
+		user.Sessions = append(user.Sessions, model.SessionBasics{
 			SessionId:      sessionId,
 			LogInTimestamp: timestamp.Unix(),
 		})
 	}
 	if q.Err() != nil {
-		log.Errorf("Error while iterating over sessions for user %s: %+v", c.Param("id"), q.Err())
+		return model.UserMeta{}, dbError(q.Err(), "Unable to read sessions for user with id %s.", id)
 	}
+	if len(user.Sessions) == 0 {
+		return model.UserMeta{}, notFoundError("No sessions were found for that persistent ID.")
+	}
+	return user, nil
+}
 
-	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
-		c.HTML(200, "user", &user)
-	} else {
-		c.JSON(200, user)
+// loadUserCounts is all that is shown of a user who opted out, when they aren't hidden entirely.
+func loadUserCounts(ctx context.Context, id string) (model.UserMeta, error) {
+	user := model.UserMeta{Hidden: true}
+	err := getUserRoundCountsStmt.QueryRowContext(ctx, id).Scan(&user.SessionCount, &user.JudgedRoundCount,
+		&user.PlayedRoundCount)
+	if err != nil {
+		return model.UserMeta{}, dbError(err, "Unable to query for user with id %s.", id)
+	}
+	if user.SessionCount == 0 {
+		return model.UserMeta{}, notFoundError("No sessions were found for that persistent ID.")
 	}
+	return user, nil
 }
@@ -0,0 +1,112 @@
+/**
+ * Copyright (c) 2020, Andy Janata
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted
+ * provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions
+ *   and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of
+ *   conditions and the following disclaimer in the documentation and/or other materials provided
+ *   with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+ * FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+ * WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/ajanata/pyx-metrics-viewer/model"
+)
+
+// how long to remember what a watermark resolved to
+const watermarkCacheTime = time.Hour
+
+// how long to wait before trying again when a watermark couldn't be looked up
+const watermarkRetryTime = time.Minute
+
+type watermarkEntry struct {
+	deck    model.DeckRef
+	expires time.Time
+}
+
+var watermarkCache = struct {
+	sync.Mutex
+	entries map[string]watermarkEntry
+}{
+	entries: map[string]watermarkEntry{},
+}
+
+// watermarkCacheSize is how many decks' names are cached.
+func watermarkCacheSize() int {
+	watermarkCache.Lock()
+	defer watermarkCache.Unlock()
+	return len(watermarkCache.entries)
+}
+
+// purgeWatermarkCache forgets every cached deck name, so that they're looked up again. It returns how
+// many there were.
+func purgeWatermarkCache() int {
+	watermarkCache.Lock()
+	defer watermarkCache.Unlock()
+	purged := len(watermarkCache.entries)
+	watermarkCache.entries = map[string]watermarkEntry{}
+	return purged
+}
+
+// resolveWatermark works out which deck a watermark is for. Names for the built-in decks come from
+// the config, and anything with a deck ID is looked up in the deck table. Anything else is just
+// named after itself.
+func resolveWatermark(watermark string) model.DeckRef {
+	if watermark == "" {
+		return model.DeckRef{}
+	}
+	ref, hasDeck := deckForWatermark(watermark)
+	if name, ok := config.Watermarks[watermark]; ok {
+		return model.DeckRef{Id: ref.Id, Name: name}
+	} else if !hasDeck {
+		return model.DeckRef{Name: watermark}
+	}
+
+	watermarkCache.Lock()
+	entry, ok := watermarkCache.entries[ref.Id]
+	watermarkCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.deck
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout())
+	defer cancel()
+	deck := model.DeckRef{Id: ref.Id}
+	expires := time.Now().Add(watermarkCacheTime)
+	var numWhite, numBlack int
+	err := getDeckInfo.QueryRowContext(ctx, ref.DbId).Scan(&deck.Name, &numWhite, &numBlack)
+	if err == sql.ErrNoRows {
+		// it looked like a deck ID, but it's not a deck we know about
+		deck = model.DeckRef{Name: watermark}
+	} else if err != nil {
+		// Don't wait on the database for every card on the page if it's having trouble, but don't
+		// remember this for long either.
+		log.Warningf("Unable to resolve watermark %s: %v", watermark, err)
+		deck = model.DeckRef{Id: ref.Id, Name: watermark}
+		expires = time.Now().Add(watermarkRetryTime)
+	}
+
+	watermarkCache.Lock()
+	watermarkCache.entries[ref.Id] = watermarkEntry{deck: deck, expires: expires}
+	watermarkCache.Unlock()
+	return deck
+}